@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	pathpkg "path"
+	"strings"
+)
+
+// Special values for ACL queries that do not name a single ref or path.
+const (
+	// aclAny asks whether some value is visible, e.g. whether a repository
+	// should be listed at all. Allow rules apply whenever their other
+	// patterns match; deny rules only if they cover every value.
+	aclAny = "\x00any"
+	// aclAll asks whether every value is visible, e.g. for a clone that
+	// exposes all refs. Allow rules must cover every value; any matching
+	// deny rule applies.
+	aclAll = "\x00all"
+)
+
+// Special entries in an ACL rule's "who" list.
+const (
+	whoEveryone      = "*"
+	whoAuthenticated = "@authenticated"
+	whoAnonymous     = "@anonymous"
+)
+
+// ACL decides which repositories, refs and paths a user may see. Rules are
+// evaluated in order and the first rule that applies wins; if none applies,
+// access is denied. A nil *ACL allows everything.
+type ACL struct {
+	groups map[string]map[string]bool // group -> set of members
+	rules  []ACLRule
+}
+
+// ACLRule allows or denies access for users and groups to repositories,
+// refs and paths matching glob patterns. In patterns "*" matches within a
+// path segment and "**" matches any number of segments.
+type ACLRule struct {
+	Allow bool
+	Who   []string // user names, "@group", "*", "@authenticated" or "@anonymous"
+	Repos []string
+	Refs  []string // branch or tag names
+	Paths []string
+}
+
+// aclPath is the path part of an ACL query.
+type aclPath struct {
+	path string // repository path, aclAny or aclAll
+	dir  bool   // path names a directory that is visible if anything below it is
+}
+
+// newACL constructs an ACL, or returns nil if no rules are configured.
+func newACL(groups map[string][]string, rules []ACLRule) *ACL {
+	if len(rules) == 0 {
+		return nil
+	}
+	a := &ACL{groups: make(map[string]map[string]bool)}
+	for _, rule := range rules {
+		// Repository names never contain slashes, so "*" covers them all.
+		repos := make([]string, len(rule.Repos))
+		for i, p := range rule.Repos {
+			if p == "*" {
+				p = "**"
+			}
+			repos[i] = p
+		}
+		rule.Repos = repos
+		a.rules = append(a.rules, rule)
+	}
+	for g, members := range groups {
+		set := make(map[string]bool)
+		for _, m := range members {
+			set[m] = true
+		}
+		a.groups[g] = set
+	}
+	return a
+}
+
+// check reports whether user may access path at ref in repo.
+func (a *ACL) check(user, repo, ref string, p aclPath) bool {
+	if a == nil {
+		return true
+	}
+	for _, rule := range a.rules {
+		if !a.matchWho(rule.Who, user) ||
+			!dimApplies(rule.Repos, repo, rule.Allow) ||
+			!dimApplies(rule.Refs, ref, rule.Allow) ||
+			!pathApplies(rule.Paths, p, rule.Allow) {
+			continue
+		}
+		return rule.Allow
+	}
+	return false
+}
+
+// matchWho reports whether user is named by any entry in who.
+func (a *ACL) matchWho(who []string, user string) bool {
+	for _, w := range who {
+		switch {
+		case w == whoEveryone:
+			return true
+		case w == whoAuthenticated:
+			if user != "" {
+				return true
+			}
+		case w == whoAnonymous:
+			if user == "" {
+				return true
+			}
+		case strings.HasPrefix(w, "@"):
+			if user != "" && a.groups[w[1:]][user] {
+				return true
+			}
+		case w == user && user != "":
+			return true
+		}
+	}
+	return false
+}
+
+// dimApplies reports whether a rule's patterns apply to value v.
+func dimApplies(patterns []string, v string, allow bool) bool {
+	switch v {
+	case aclAny:
+		return allow || coversAll(patterns)
+	case aclAll:
+		return !allow || coversAll(patterns)
+	default:
+		return matchAny(patterns, v)
+	}
+}
+
+// pathApplies is dimApplies for paths, treating directories as visible if
+// an allow rule could match anything below them.
+func pathApplies(patterns []string, p aclPath, allow bool) bool {
+	if !p.dir || p.path == aclAny || p.path == aclAll {
+		return dimApplies(patterns, p.path, allow)
+	}
+	if matchAny(patterns, p.path) {
+		return true
+	}
+	if !allow {
+		return false
+	}
+	for _, pat := range patterns {
+		if globCouldMatchBelow(pat, p.path) {
+			return true
+		}
+	}
+	return false
+}
+
+// coversAll reports whether any pattern matches every value.
+func coversAll(patterns []string) bool {
+	for _, p := range patterns {
+		if p == "**" {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAny reports whether any pattern matches name.
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if globMatch(p, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// globMatch matches a slash-separated name against a pattern in which "**"
+// matches zero or more segments and other segments use path.Match syntax.
+func globMatch(pattern, name string) bool {
+	return matchSegments(splitSegments(pattern), splitSegments(name))
+}
+
+func matchSegments(pat, name []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pat[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := pathpkg.Match(pat[0], name[0]); !ok {
+			return false
+		}
+		pat, name = pat[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// globCouldMatchBelow reports whether pattern can match some path inside
+// directory dir.
+func globCouldMatchBelow(pattern, dir string) bool {
+	pat, name := splitSegments(pattern), splitSegments(dir)
+	for _, seg := range name {
+		if len(pat) == 0 {
+			return false
+		}
+		if pat[0] == "**" {
+			return true
+		}
+		if ok, _ := pathpkg.Match(pat[0], seg); !ok {
+			return false
+		}
+		pat = pat[1:]
+	}
+	return len(pat) > 0
+}
+
+// splitSegments splits a slash-separated name, mapping "" to no segments.
+func splitSegments(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "/")
+}
+
+// allowed reports whether the request's user may access p at ref in this
+// repository. Refs that are not plain branch or tag names (commit IDs,
+// expressions like main~1) require access to every ref.
+func (s *Server) allowed(r *http.Request, ref string, p aclPath) bool {
+	if s.acl == nil {
+		return true
+	}
+	return s.checkACL(r, s.aclRef(r.Context(), ref), p)
+}
+
+// checkACL is allowed for a ref already mapped by aclRef.
+func (s *Server) checkACL(r *http.Request, aclRef string, p aclPath) bool {
+	return s.acl.check(userFromContext(r.Context()), s.repoName, aclRef, p)
+}
+
+// aclRef maps a ref from a request to the name ACL rules are matched on.
+func (s *Server) aclRef(ctx context.Context, ref string) string {
+	if ref == aclAny || ref == aclAll {
+		return ref
+	}
+	if ref == "HEAD" {
+		if out, err := runGit(ctx, s.repoPath, "symbolic-ref", "--quiet", "--short", "HEAD"); err == nil {
+			return strings.TrimSpace(out)
+		}
+		return aclAll
+	}
+	for _, prefix := range []string{"refs/heads/", "refs/tags/"} {
+		name := strings.TrimPrefix(ref, prefix)
+		if has, err := gitHasRef(ctx, s.repoPath, prefix+name); err == nil && has {
+			return name
+		}
+	}
+	return aclAll
+}
+
+// visibleRepo reports whether the request's user may see anything in the
+// repository.
+func (s *Server) visibleRepo(r *http.Request) bool {
+	return s.allowed(r, aclAny, aclPath{path: aclAny})
+}
+
+// visibleBranches filters branch names to those the request's user may see.
+func (s *Server) visibleBranches(r *http.Request, branches []string) []string {
+	if s.acl == nil {
+		return branches
+	}
+	var out []string
+	for _, b := range branches {
+		if s.checkACL(r, b, aclPath{path: aclAny}) {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// guard hides the repository from users who may not see any of it.
+func (s *Server) guard(next http.Handler) http.Handler {
+	if s.acl == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.visibleRepo(r) {
+			writeNotFound(w, r, s.tmpls, s.cfg.BasePath, s.multiRepo)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// guardClone only lets users who may see every ref and path clone the
+// repository, since a clone transfers all of it.
+func (s *Server) guardClone(next http.Handler) http.Handler {
+	if s.acl == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.allowed(r, aclAll, aclPath{path: aclAll}) {
+			writeNotFound(w, r, s.tmpls, s.cfg.BasePath, s.multiRepo)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// filterEntries drops tree entries in dir the request's user may not see.
+func (s *Server) filterEntries(r *http.Request, ref, dir string, entries []TreeEntry) []TreeEntry {
+	if s.acl == nil {
+		return entries
+	}
+	name := s.aclRef(r.Context(), ref)
+	var out []TreeEntry
+	for _, e := range entries {
+		full := e.Name
+		if dir != "" {
+			full = dir + "/" + e.Name
+		}
+		if s.checkACL(r, name, aclPath{path: full, dir: e.IsDir() || e.IsSubmodule()}) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
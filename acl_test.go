@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"**", "", true},
+		{"**", "a/b/c", true},
+		{"docs", "docs", true},
+		{"docs", "docs/a", false},
+		{"docs/*", "docs/a", true},
+		{"docs/*", "docs/a/b", false},
+		{"docs/**", "docs", true},
+		{"docs/**", "docs/a/b", true},
+		{"docs/**", "docsx/a", false},
+		{"**/*.md", "README.md", true},
+		{"**/*.md", "a/b/c.md", true},
+		{"**/*.md", "a/b/c.mdx", false},
+		{"a/**/z", "a/z", true},
+		{"a/**/z", "a/b/c/z", true},
+		{"release/v[0-9]*", "release/v2.1", true},
+		{"release/v[0-9]*", "release/vx", false},
+		{"feature-?", "feature-a", true},
+	}
+	for _, tt := range tests {
+		if got := globMatch(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGlobCouldMatchBelow(t *testing.T) {
+	tests := []struct {
+		pattern, dir string
+		want         bool
+	}{
+		{"docs/guide/*.html", "docs", true},
+		{"docs/guide/*.html", "docs/guide", true},
+		{"docs/guide/*.html", "src", false},
+		{"docs/*/index.html", "docs/anything", true},
+		{"docs", "docs", false},
+		{"docs/**", "docs/a/b", true},
+		{"**/secret", "a/b", true},
+		{"", "docs", false},
+	}
+	for _, tt := range tests {
+		if got := globCouldMatchBelow(tt.pattern, tt.dir); got != tt.want {
+			t.Errorf("globCouldMatchBelow(%q, %q) = %v, want %v", tt.pattern, tt.dir, got, tt.want)
+		}
+	}
+}
+
+func TestACLCheck(t *testing.T) {
+	all := []string{"**"}
+	acl := newACL(map[string][]string{"devs": {"alice", "bob"}}, []ACLRule{
+		// Nobody sees the secrets folder or the private branches.
+		{Allow: false, Who: []string{"*"}, Repos: []string{"*"}, Refs: all, Paths: []string{"secrets/**"}},
+		{Allow: false, Who: []string{"*"}, Repos: []string{"*"}, Refs: []string{"private/**"}, Paths: all},
+		// Developers see everything else, carol only the docs of app.
+		{Allow: true, Who: []string{"@devs"}, Repos: []string{"*"}, Refs: all, Paths: all},
+		{Allow: true, Who: []string{"carol"}, Repos: []string{"app"}, Refs: []string{"main"}, Paths: []string{"docs/**"}},
+		// Anonymous users see the public repository.
+		{Allow: true, Who: []string{"@anonymous"}, Repos: []string{"public"}, Refs: all, Paths: all},
+		{Allow: true, Who: []string{"@authenticated"}, Repos: []string{"wiki"}, Refs: all, Paths: all},
+	})
+	file := func(p string) aclPath { return aclPath{path: p} }
+	dir := func(p string) aclPath { return aclPath{path: p, dir: true} }
+	tests := []struct {
+		name            string
+		user, repo, ref string
+		path            aclPath
+		want            bool
+	}{
+		{"group member", "alice", "app", "main", file("src/main.go"), true},
+		{"deny before allow", "alice", "app", "main", file("secrets/key"), false},
+		{"denied ref", "bob", "app", "private/x", file("README.md"), false},
+		{"no rule applies", "mallory", "app", "main", file("README.md"), false},
+		{"user path rule", "carol", "app", "main", file("docs/index.html"), true},
+		{"outside user path rule", "carol", "app", "main", file("src/main.go"), false},
+		{"other ref", "carol", "app", "dev", file("docs/index.html"), false},
+		{"directory above an allowed path", "carol", "app", "main", dir("docs"), true},
+		{"root directory", "carol", "app", "main", dir(""), true},
+		{"unrelated directory", "carol", "app", "main", dir("src"), false},
+		{"denied directory", "alice", "app", "main", dir("secrets"), false},
+		{"anonymous", "", "public", "main", file("README.md"), true},
+		{"anonymous is not a user", "", "app", "main", file("README.md"), false},
+		{"signed-in user on anonymous rule", "carol", "public", "main", file("README.md"), false},
+		{"authenticated", "carol", "wiki", "main", file("README.md"), true},
+		{"authenticated excludes anonymous", "", "wiki", "main", file("README.md"), false},
+
+		// A repository or ref is listed if anything in it is visible,
+		// unless a deny rule covers all of it.
+		{"any path", "carol", "app", "main", aclPath{path: aclAny}, true},
+		{"any ref", "carol", "app", aclAny, aclPath{path: aclAny}, true},
+		{"any path of a denied ref", "alice", "app", "private/x", aclPath{path: aclAny}, false},
+		{"any path with a denied folder", "alice", "app", "main", aclPath{path: aclAny}, true},
+		{"any path of another repo", "carol", "wiki", "main", aclPath{path: aclAny}, true},
+		{"any path without a rule", "carol", "other", "main", aclPath{path: aclAny}, false},
+
+		// Cloning needs every ref and path.
+		{"all of a partly visible repo", "carol", "app", aclAll, aclPath{path: aclAll}, false},
+		{"all with a denied folder", "alice", "app", aclAll, aclPath{path: aclAll}, false},
+		{"all of a public repo", "", "public", aclAll, aclPath{path: aclAll}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := acl.check(tt.user, tt.repo, tt.ref, tt.path); got != tt.want {
+				t.Errorf("check(%q, %q, %q, %+v) = %v, want %v", tt.user, tt.repo, tt.ref, tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestACLCheckAll(t *testing.T) {
+	all := []string{"**"}
+	acl := newACL(nil, []ACLRule{
+		{Allow: false, Who: []string{"*"}, Repos: []string{"*"}, Refs: all, Paths: []string{"secrets/**"}},
+		{Allow: true, Who: []string{"*"}, Repos: []string{"public"}, Refs: all, Paths: all},
+		{Allow: true, Who: []string{"*"}, Repos: []string{"app"}, Refs: []string{"main"}, Paths: all},
+	})
+	// The deny rule matches every repository, so no clone exposes all paths.
+	if acl.check("", "public", aclAll, aclPath{path: aclAll}) {
+		t.Error("clone allowed despite a denied folder")
+	}
+	acl = newACL(nil, acl.rules[1:])
+	if !acl.check("", "public", aclAll, aclPath{path: aclAll}) {
+		t.Error("clone of a fully visible repository denied")
+	}
+	if acl.check("", "app", aclAll, aclPath{path: aclAll}) {
+		t.Error("clone allowed with only one visible ref")
+	}
+}
+
+func TestNilACL(t *testing.T) {
+	var acl *ACL
+	if !acl.check("", "any", aclAll, aclPath{path: aclAll}) {
+		t.Error("nil ACL denied access")
+	}
+	if newACL(nil, nil) != nil {
+		t.Error("newACL without rules is not nil")
+	}
+}
+
+func TestCommitsNeedAllPaths(t *testing.T) {
+	tmpls, err := loadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{repoPath: newTestRepo(t), repoName: "app", tmpls: tmpls, cfg: defaultConfig()}
+	get := func() int {
+		w := httptest.NewRecorder()
+		s.handleCommits(w, httptest.NewRequest(http.MethodGet, "/commits?ref=main", nil))
+		return w.Code
+	}
+
+	s.acl = newACL(nil, []ACLRule{{Allow: true, Who: []string{"*"}, Repos: []string{"app"}, Refs: []string{"main"}, Paths: []string{"docs/**"}}})
+	if code := get(); code != http.StatusNotFound {
+		t.Errorf("commits of a partly visible ref: %d, want 404", code)
+	}
+	s.acl = newACL(nil, []ACLRule{{Allow: true, Who: []string{"*"}, Repos: []string{"app"}, Refs: []string{"main"}, Paths: []string{"**"}}})
+	if code := get(); code != http.StatusOK {
+		t.Errorf("commits of a fully visible ref: %d, want 200", code)
+	}
+}
@@ -0,0 +1,670 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	pathpkg "path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// sessionCookie is the name of the signed login session cookie.
+const sessionCookie = "gitviewer_session"
+
+// sessionTTL is how long a login session stays valid.
+const sessionTTL = 24 * time.Hour
+
+// passwordCacheTTL is how long a successful password check is remembered,
+// so that scripts sending HTTP Basic credentials with every request do not
+// pay for bcrypt each time.
+const passwordCacheTTL = time.Minute
+
+// A client IP that fails maxLoginFailures password checks within
+// loginFailureWindow may not try again until the window has passed.
+const (
+	maxLoginFailures   = 5
+	loginFailureWindow = 15 * time.Minute
+)
+
+// errAuthRequired is the reason given to anonymous requests for routes
+// that are not public.
+var errAuthRequired = errors.New("authentication required")
+
+// userKey is the context key under which the authenticated user is stored.
+type userKey struct{}
+
+// userFromContext returns the authenticated user name, or "" for anonymous
+// requests.
+func userFromContext(ctx context.Context) string {
+	user, _ := ctx.Value(userKey{}).(string)
+	return user
+}
+
+// Auth authenticates requests using HTTP Basic credentials checked against
+// an htpasswd file, bearer API tokens, or a signed session cookie set by the
+// login form. Unauthenticated requests are only allowed for public routes.
+type Auth struct {
+	htpasswd *htpasswdFile
+	tokens   map[[sha256.Size]byte]string // sha256(token) -> user
+	secret   []byte
+	public   []string // relative to root
+	root     string   // base path of the site
+	tmpls    map[string]*template.Template
+	failures loginThrottle
+	verified passwordCache
+	revoked  sessionRevocations
+}
+
+// LoginData contains data for the login page.
+type LoginData struct {
+	BaseData
+	Next  string
+	Error string
+}
+
+// newAuth constructs an Auth from the config, or returns nil if no users
+// or tokens are configured. The login routes are served below root.
+func newAuth(cfg AuthConfig, root string, tmpls map[string]*template.Template) (*Auth, error) {
+	if !cfg.enabled() {
+		return nil, nil
+	}
+	a := &Auth{
+		tokens: make(map[[sha256.Size]byte]string),
+		public: cfg.Public,
+		root:   root,
+		tmpls:  tmpls,
+	}
+	if cfg.Htpasswd != "" {
+		h := &htpasswdFile{path: cfg.Htpasswd}
+		if err := h.reload(); err != nil {
+			return nil, err
+		}
+		a.htpasswd = h
+	}
+	for _, t := range cfg.Tokens {
+		a.tokens[sha256.Sum256([]byte(t.Token))] = t.User
+	}
+	if cfg.SessionSecret != "" {
+		a.secret = []byte(cfg.SessionSecret)
+	} else {
+		a.secret = make([]byte, 32)
+		if _, err := rand.Read(a.secret); err != nil {
+			return nil, err
+		}
+		slog.Warn("no auth.session_secret configured, sessions will not survive a restart")
+	}
+	return a, nil
+}
+
+// middleware rejects unauthenticated requests to non-public routes and
+// stores the authenticated user in the request context.
+func (a *Auth) middleware(next http.Handler) http.Handler {
+	return a.wrap(next, true)
+}
+
+// pagesMiddleware is middleware for the pages origin. It has no login form,
+// since branch content served from the same origin could imitate it, and
+// asks browsers for Basic credentials instead.
+func (a *Auth) pagesMiddleware(next http.Handler) http.Handler {
+	return a.wrap(next, false)
+}
+
+// vhostMiddleware is pagesMiddleware for branch host names. They have no
+// base path and no public routes: every request needs credentials.
+func (a *Auth) vhostMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := a.authenticate(r)
+		if err == nil && user == "" {
+			err = errAuthRequired
+		}
+		if err != nil {
+			a.challenge(w, r, err, false)
+			return
+		}
+		setLogUser(r, user)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, user)))
+	})
+}
+
+// wrap implements middleware and pagesMiddleware; loginForm enables the
+// login and logout pages.
+func (a *Auth) wrap(next http.Handler, loginForm bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, ok := strings.CutPrefix(r.URL.Path, a.root)
+		if !ok {
+			writePlainError(w, r, a.tmpls, a.root, http.StatusNotFound, "Page not found")
+			return
+		}
+		if loginForm {
+			switch path {
+			case "/login":
+				setRoute(r, path)
+				a.handleLogin(w, r)
+				return
+			case "/logout":
+				setRoute(r, path)
+				a.handleLogout(w, r)
+				return
+			}
+		}
+
+		user, err := a.authenticate(r)
+		if err != nil {
+			a.challenge(w, r, err, loginForm)
+			return
+		}
+		if user == "" && !a.isPublic(path) {
+			a.challenge(w, r, errAuthRequired, loginForm)
+			return
+		}
+		if user != "" {
+			setLogUser(r, user)
+			r = r.WithContext(context.WithValue(r.Context(), userKey{}, user))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticate returns the user identified by the request's credentials.
+// It returns "" without error for requests that carry no credentials, and
+// an error for credentials that are present but invalid.
+func (a *Auth) authenticate(r *http.Request) (string, error) {
+	if h := r.Header.Get("Authorization"); h != "" {
+		if token, ok := strings.CutPrefix(h, "Bearer "); ok {
+			if user, ok := a.tokens[sha256.Sum256([]byte(token))]; ok {
+				return user, nil
+			}
+			return "", errors.New("invalid API token")
+		}
+		if user, pass, ok := r.BasicAuth(); ok {
+			return a.login(r, user, pass)
+		}
+		return "", errors.New("unsupported authorization scheme")
+	}
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		// Sessions end as soon as the user is removed from htpasswd.
+		if user, ok := a.verifySession(c.Value); ok && a.htpasswd != nil {
+			if _, exists := a.htpasswd.lookup(user); exists {
+				return user, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// login checks a password sent by the request's client, which may only
+// guess so many times.
+func (a *Auth) login(r *http.Request, user, pass string) (string, error) {
+	client, now := clientIP(r), time.Now()
+	if wait := a.failures.wait(client, now); wait > 0 {
+		return "", &throttledError{wait: wait}
+	}
+	if !a.checkPassword(user, pass) {
+		slog.WarnContext(r.Context(), "failed login", "user", user, "client", client)
+		if a.failures.fail(client, now) {
+			slog.WarnContext(r.Context(), "too many failed logins, locking out client", "client", client, "duration", loginFailureWindow)
+		}
+		return "", errors.New("invalid username or password")
+	}
+	a.failures.reset(client)
+	return user, nil
+}
+
+// checkPassword verifies a user's password against the htpasswd file.
+func (a *Auth) checkPassword(user, pass string) bool {
+	if a.htpasswd == nil {
+		return false
+	}
+	hash, ok := a.htpasswd.lookup(user)
+	if !ok {
+		// Take as long as for a known user, so that response times do not
+		// tell which user names exist.
+		bcrypt.CompareHashAndPassword(a.htpasswd.dummyHash(), []byte(pass))
+		return false
+	}
+	now := time.Now()
+	cached := a.verified.has(user, pass, hash, now)
+	metrics.observeCache("password", cached)
+	if cached {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) != nil {
+		return false
+	}
+	a.verified.add(user, pass, hash, now)
+	return true
+}
+
+// isPublic reports whether path, relative to the base path, may be accessed
+// without authentication. Entries ending in "/" match as prefixes, others as
+// path.Match patterns.
+func (a *Auth) isPublic(path string) bool {
+	if strings.HasPrefix(path, "/static/") {
+		return true
+	}
+	for _, p := range a.public {
+		if strings.HasSuffix(p, "/") && strings.HasPrefix(path, p) {
+			return true
+		}
+		if ok, _ := pathpkg.Match(p, path); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// challenge asks the client to authenticate. Browsers navigating to a page
+// are sent to the login form if there is one; everything else, including
+// git, gets a 401 with a Basic challenge. Clients locked out after failed
+// logins get a 429 instead.
+func (a *Auth) challenge(w http.ResponseWriter, r *http.Request, err error, loginForm bool) {
+	var throttled *throttledError
+	if errors.As(err, &throttled) {
+		w.Header().Set("Retry-After", throttled.retryAfter())
+		writePlainError(w, r, a.tmpls, a.root, http.StatusTooManyRequests, err.Error())
+		return
+	}
+	if loginForm && r.Method == http.MethodGet && r.Header.Get("Authorization") == "" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, a.root+"/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="gitViewer", charset="UTF-8"`)
+	writePlainError(w, r, a.tmpls, a.root, http.StatusUnauthorized, err.Error())
+}
+
+// handleLogin shows the login form and starts a session on success.
+func (a *Auth) handleLogin(w http.ResponseWriter, r *http.Request) {
+	data := LoginData{BaseData: BaseData{Root: a.root}, Next: a.safeNext(r.FormValue("next"))}
+	if r.Method == http.MethodPost {
+		user, err := a.login(r, r.PostFormValue("username"), r.PostFormValue("password"))
+		if err == nil {
+			http.SetCookie(w, &http.Cookie{
+				Name:     sessionCookie,
+				Value:    a.signSession(user, time.Now().Add(sessionTTL)),
+				Path:     a.root + "/",
+				MaxAge:   int(sessionTTL / time.Second),
+				HttpOnly: true,
+				Secure:   requestScheme(r) == "https",
+				SameSite: http.SameSiteLaxMode,
+			})
+			http.Redirect(w, r, data.Next, http.StatusSeeOther)
+			return
+		}
+		var throttled *throttledError
+		if errors.As(err, &throttled) {
+			data.Error = "Too many failed logins. Try again in " + throttled.wait.Round(time.Second).String() + "."
+			w.Header().Set("Retry-After", throttled.retryAfter())
+			w.WriteHeader(http.StatusTooManyRequests)
+		} else {
+			data.Error = "Invalid username or password."
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}
+
+	t, ok := a.tmpls["login"]
+	if !ok {
+		slog.ErrorContext(r.Context(), "template not found", "template", "login")
+		http.Error(w, "template not found", http.StatusInternalServerError)
+		return
+	}
+	if err := t.ExecuteTemplate(w, "login", data); err != nil {
+		slog.ErrorContext(r.Context(), "render template", "template", "login", "err", err)
+	}
+}
+
+// handleLogout ends the session.
+func (a *Auth) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writePlainError(w, r, a.tmpls, a.root, http.StatusMethodNotAllowed, "Log out with a POST request")
+		return
+	}
+	// The browser drops the cookie, but a copy of it must not stay valid.
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		if _, expires, sig, ok := a.parseSession(c.Value); ok {
+			a.revoked.add(sig, expires, time.Now())
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     a.root + "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   requestScheme(r) == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, a.root+"/login", http.StatusSeeOther)
+}
+
+// signSession returns a cookie value binding user to an expiry time.
+func (a *Auth) signSession(user string, expires time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(user)) + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + a.mac(payload)
+}
+
+// verifySession checks a cookie value's signature and expiry, and that it
+// was not revoked by logging out.
+func (a *Auth) verifySession(value string) (string, bool) {
+	user, expires, sig, ok := a.parseSession(value)
+	now := time.Now()
+	if !ok || now.After(expires) || a.revoked.has(sig, now) {
+		return "", false
+	}
+	return user, true
+}
+
+// parseSession checks a cookie value's signature and returns the user, the
+// expiry time and the signature, which identifies the session.
+func (a *Auth) parseSession(value string) (user string, expires time.Time, sig string, ok bool) {
+	i := strings.LastIndexByte(value, '.')
+	if i < 0 {
+		return "", time.Time{}, "", false
+	}
+	payload, sig := value[:i], value[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(a.mac(payload))) {
+		return "", time.Time{}, "", false
+	}
+	encUser, expStr, ok := strings.Cut(payload, ".")
+	if !ok {
+		return "", time.Time{}, "", false
+	}
+	exp, err := strconv.ParseInt(expStr, 10, 64)
+	if err != nil {
+		return "", time.Time{}, "", false
+	}
+	name, err := base64.RawURLEncoding.DecodeString(encUser)
+	if err != nil {
+		return "", time.Time{}, "", false
+	}
+	return string(name), time.Unix(exp, 0), sig, true
+}
+
+// mac returns the base64 HMAC-SHA256 of payload under the session secret.
+func (a *Auth) mac(payload string) string {
+	m := hmac.New(sha256.New, a.secret)
+	m.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// safeNext only allows redirects to local paths below the base path after
+// login.
+func (a *Auth) safeNext(next string) string {
+	if !strings.HasPrefix(next, a.root+"/") || strings.HasPrefix(next, "//") || strings.Contains(next, "\\") {
+		return a.root + "/"
+	}
+	return next
+}
+
+// htpasswdFile holds bcrypt password hashes from an Apache htpasswd file.
+// The file is re-read when its modification time changes, so users can be
+// added without restarting the server.
+type htpasswdFile struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	users   map[string]string
+	dummy   []byte // hash checked for unknown users, at the file's cost
+}
+
+// lookup returns the password hash for user.
+func (h *htpasswdFile) lookup(user string) (string, bool) {
+	if err := h.reload(); err != nil {
+		slog.Error("reload htpasswd", "err", err)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hash, ok := h.users[user]
+	return hash, ok
+}
+
+// dummyHash returns a hash of a password nobody has, at the highest cost
+// used in the file.
+func (h *htpasswdFile) dummyHash() []byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.dummy
+}
+
+// reload re-reads the file if it changed since the last read.
+func (h *htpasswdFile) reload() error {
+	fi, err := os.Stat(h.path)
+	if err != nil {
+		return fmt.Errorf("htpasswd: %w", err)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.users != nil && fi.ModTime().Equal(h.modTime) {
+		return nil
+	}
+
+	f, err := os.Open(h.path)
+	if err != nil {
+		return fmt.Errorf("htpasswd: %w", err)
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	cost := bcrypt.MinCost
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			return fmt.Errorf("htpasswd %s:%d: expected user:hash", h.path, n)
+		}
+		if !strings.HasPrefix(hash, "$2") {
+			slog.Warn("ignoring htpasswd user, only bcrypt hashes (htpasswd -B) are supported", "path", h.path, "line", n, "user", user)
+			continue
+		}
+		users[user] = hash
+		if c, err := bcrypt.Cost([]byte(hash)); err == nil {
+			cost = max(cost, c)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("htpasswd: %w", err)
+	}
+	if dummyCost, _ := bcrypt.Cost(h.dummy); cost != dummyCost {
+		dummy, err := bcrypt.GenerateFromPassword([]byte("no user has this password"), cost)
+		if err != nil {
+			return fmt.Errorf("htpasswd: %w", err)
+		}
+		h.dummy = dummy
+	}
+	h.users = users
+	h.modTime = fi.ModTime()
+	return nil
+}
+
+// throttledError rejects a password check from a client locked out after
+// too many failed logins.
+type throttledError struct {
+	wait time.Duration // until the client may try again
+}
+
+func (e *throttledError) Error() string {
+	return "too many failed logins, try again in " + e.wait.Round(time.Second).String()
+}
+
+// retryAfter returns the wait as a Retry-After value.
+func (e *throttledError) retryAfter() string {
+	return strconv.Itoa(int(math.Ceil(e.wait.Seconds())))
+}
+
+// loginThrottle counts failed password checks per client IP.
+type loginThrottle struct {
+	mu        sync.Mutex
+	clients   map[string]*loginFailures
+	lastSweep time.Time
+}
+
+type loginFailures struct {
+	count int
+	since time.Time // first failure of the current window
+}
+
+// wait returns how long client must wait before its next password check,
+// 0 if it may try now.
+func (t *loginThrottle) wait(client string, now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, ok := t.clients[client]
+	if !ok || f.count < maxLoginFailures {
+		return 0
+	}
+	return max(0, f.since.Add(loginFailureWindow).Sub(now))
+}
+
+// fail records a failed password check by client and reports whether it
+// used up the client's last attempt.
+func (t *loginThrottle) fail(client string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sweep(now)
+	f, ok := t.clients[client]
+	if !ok || now.Sub(f.since) >= loginFailureWindow {
+		f = &loginFailures{since: now}
+		if t.clients == nil {
+			t.clients = make(map[string]*loginFailures)
+		}
+		t.clients[client] = f
+	}
+	f.count++
+	return f.count == maxLoginFailures
+}
+
+// reset forgets the failures of client after a successful login.
+func (t *loginThrottle) reset(client string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.clients, client)
+}
+
+// sweep forgets clients whose window has passed, at most once a minute. It
+// must be called with t.mu held.
+func (t *loginThrottle) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < time.Minute {
+		return
+	}
+	t.lastSweep = now
+	for c, f := range t.clients {
+		if now.Sub(f.since) >= loginFailureWindow {
+			delete(t.clients, c)
+		}
+	}
+}
+
+// passwordCache remembers successful password checks for passwordCacheTTL.
+// Passwords are only kept as SHA-256 digests, and an entry only counts
+// while the user's htpasswd hash is the one it was checked against.
+type passwordCache struct {
+	mu        sync.Mutex
+	entries   map[passwordKey]passwordEntry
+	lastSweep time.Time
+}
+
+type passwordKey struct {
+	user string
+	pass [sha256.Size]byte
+}
+
+type passwordEntry struct {
+	hash    string // htpasswd hash the password matched
+	expires time.Time
+}
+
+// has reports whether pass was recently found to match hash for user.
+func (c *passwordCache) has(user, pass, hash string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[passwordKey{user, sha256.Sum256([]byte(pass))}]
+	return ok && e.hash == hash && now.Before(e.expires)
+}
+
+// add remembers that pass matches hash for user.
+func (c *passwordCache) add(user, pass, hash string, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sweep(now)
+	if c.entries == nil {
+		c.entries = make(map[passwordKey]passwordEntry)
+	}
+	c.entries[passwordKey{user, sha256.Sum256([]byte(pass))}] = passwordEntry{hash: hash, expires: now.Add(passwordCacheTTL)}
+}
+
+// sweep forgets expired entries, at most once a minute. It must be called
+// with c.mu held.
+func (c *passwordCache) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < time.Minute {
+		return
+	}
+	c.lastSweep = now
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+}
+
+// sessionRevocations holds the signatures of logged-out sessions until they
+// would have expired anyway. It lives in memory only, so a restart forgets
+// it; see the README.
+type sessionRevocations struct {
+	mu        sync.Mutex
+	sigs      map[string]time.Time // signature -> session expiry
+	lastSweep time.Time
+}
+
+// add revokes the session with signature sig, valid until expires.
+func (rv *sessionRevocations) add(sig string, expires, now time.Time) {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	rv.sweep(now)
+	if rv.sigs == nil {
+		rv.sigs = make(map[string]time.Time)
+	}
+	rv.sigs[sig] = expires
+}
+
+// has reports whether the session with signature sig was revoked.
+func (rv *sessionRevocations) has(sig string, now time.Time) bool {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	expires, ok := rv.sigs[sig]
+	return ok && !now.After(expires)
+}
+
+// sweep forgets sessions that have expired, at most once a minute. It must
+// be called with rv.mu held.
+func (rv *sessionRevocations) sweep(now time.Time) {
+	if now.Sub(rv.lastSweep) < time.Minute {
+		return
+	}
+	rv.lastSweep = now
+	for sig, expires := range rv.sigs {
+		if now.After(expires) {
+			delete(rv.sigs, sig)
+		}
+	}
+}
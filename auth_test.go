@@ -0,0 +1,457 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testToken is the API token of user "ci" in newTestAuth.
+const testToken = "0123456789abcdefghijklmnop"
+
+// writeHtpasswd writes an htpasswd file with the given lines.
+func writeHtpasswd(t *testing.T, path string, lines ...string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// bcryptLine returns an htpasswd line for user with password pass.
+func bcryptLine(t *testing.T, user, pass string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user + ":" + string(hash)
+}
+
+// newTestAuth returns an Auth for alice with password "secret", bob with
+// "hunter2" and the API token testToken, and the htpasswd file's path.
+func newTestAuth(t *testing.T, public ...string) (*Auth, string) {
+	t.Helper()
+	htpasswd := filepath.Join(t.TempDir(), "htpasswd")
+	writeHtpasswd(t, htpasswd, bcryptLine(t, "alice", "secret"), bcryptLine(t, "bob", "hunter2"))
+	a, err := newAuth(AuthConfig{
+		Htpasswd:      htpasswd,
+		SessionSecret: "test secret",
+		Public:        public,
+		Tokens:        []TokenConfig{{User: "ci", Token: testToken}},
+	}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, htpasswd
+}
+
+func TestSessionCookie(t *testing.T) {
+	a, _ := newTestAuth(t)
+	value := a.signSession("alice", time.Now().Add(time.Hour))
+	if user, ok := a.verifySession(value); !ok || user != "alice" {
+		t.Fatalf("verifySession(signed) = %q, %v", user, ok)
+	}
+
+	revoked := a.signSession("alice", time.Now().Add(time.Hour+time.Second))
+	if _, expires, sig, ok := a.parseSession(revoked); ok {
+		a.revoked.add(sig, expires, time.Now())
+	}
+
+	other, _ := newTestAuth(t)
+	other.secret = []byte("another secret")
+	user, expiry, _ := strings.Cut(value, ".")
+	expiry, sig, _ := strings.Cut(expiry, ".")
+	bob := base64.RawURLEncoding.EncodeToString([]byte("bob"))
+	tests := map[string]string{
+		"expired":       a.signSession("alice", time.Now().Add(-time.Second)),
+		"other secret":  other.signSession("alice", time.Now().Add(time.Hour)),
+		"user swapped":  bob + "." + expiry + "." + sig,
+		"later expiry":  user + ".9999999999." + sig,
+		"no signature":  user + "." + expiry,
+		"bad signature": user + "." + expiry + "." + sig[:len(sig)-2] + "xx",
+		"empty":         "",
+		"garbage":       "garbage",
+		"bad expiry":    user + ".soon." + a.mac(user+".soon"),
+		"bad user":      "!!!." + expiry + "." + a.mac("!!!."+expiry),
+		"revoked":       revoked,
+	}
+	for name, v := range tests {
+		if user, ok := a.verifySession(v); ok {
+			t.Errorf("%s: verifySession(%q) = %q, true", name, v, user)
+		}
+	}
+}
+
+func TestHtpasswdFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeHtpasswd(t, path,
+		"# users",
+		"",
+		bcryptLine(t, "alice", "secret"),
+		"bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", // not bcrypt, skipped
+		"  "+bcryptLine(t, "carol", "pw")+"  ",
+	)
+	h := &htpasswdFile{path: path}
+	if err := h.reload(); err != nil {
+		t.Fatal(err)
+	}
+	for user, want := range map[string]bool{"alice": true, "bob": false, "carol": true, "dave": false} {
+		if _, ok := h.lookup(user); ok != want {
+			t.Errorf("lookup(%q) = %v, want %v", user, ok, want)
+		}
+	}
+
+	if cost, err := bcrypt.Cost(h.dummyHash()); cost != bcrypt.MinCost {
+		t.Errorf("dummy hash cost = %d, %v; want %d", cost, err, bcrypt.MinCost)
+	}
+
+	// Changes are picked up without a restart.
+	costly, err := bcrypt.GenerateFromPassword([]byte("pw"), bcrypt.MinCost+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeHtpasswd(t, path, bcryptLine(t, "dave", "pw"), "erin:"+string(costly))
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := h.lookup("dave"); !ok {
+		t.Error("added user not found after reload")
+	}
+	if _, ok := h.lookup("alice"); ok {
+		t.Error("removed user still found after reload")
+	}
+	// Unknown users are checked against a hash as costly as the real ones.
+	if cost, _ := bcrypt.Cost(h.dummyHash()); cost != bcrypt.MinCost+1 {
+		t.Errorf("dummy hash cost = %d after reload, want %d", cost, bcrypt.MinCost+1)
+	}
+
+	writeHtpasswd(t, path, "no hash here")
+	if err := (&htpasswdFile{path: path}).reload(); err == nil || !strings.Contains(err.Error(), ":1: expected user:hash") {
+		t.Errorf("malformed file: %v", err)
+	}
+	if err := (&htpasswdFile{path: path + ".missing"}).reload(); err == nil {
+		t.Error("missing file loaded")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	a, htpasswd := newTestAuth(t)
+	request := func(setup func(r *http.Request)) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		setup(r)
+		return r
+	}
+	session := &http.Cookie{Name: sessionCookie, Value: a.signSession("bob", time.Now().Add(time.Hour))}
+	tests := []struct {
+		name    string
+		setup   func(r *http.Request)
+		user    string
+		invalid bool
+	}{
+		{"anonymous", func(r *http.Request) {}, "", false},
+		{"token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+testToken) }, "ci", false},
+		{"wrong token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+testToken+"x") }, "", true},
+		{"basic", func(r *http.Request) { r.SetBasicAuth("alice", "secret") }, "alice", false},
+		{"wrong password", func(r *http.Request) { r.SetBasicAuth("alice", "hunter2") }, "", true},
+		{"unknown user", func(r *http.Request) { r.SetBasicAuth("mallory", "secret") }, "", true},
+		{"token user has no password", func(r *http.Request) { r.SetBasicAuth("ci", testToken) }, "", true},
+		{"other scheme", func(r *http.Request) { r.Header.Set("Authorization", "Digest x") }, "", true},
+		{"session", func(r *http.Request) { r.AddCookie(session) }, "bob", false},
+		{"bad session", func(r *http.Request) { r.AddCookie(&http.Cookie{Name: sessionCookie, Value: "x.1.y"}) }, "", false},
+	}
+	for _, tt := range tests {
+		user, err := a.authenticate(request(tt.setup))
+		if user != tt.user || (err != nil) != tt.invalid {
+			t.Errorf("%s: authenticate = %q, %v", tt.name, user, err)
+		}
+	}
+
+	// Removing a user ends their sessions, and a changed password is
+	// checked again even though the old one was just accepted.
+	writeHtpasswd(t, htpasswd, bcryptLine(t, "alice", "changed"))
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(htpasswd, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if user, err := a.authenticate(request(func(r *http.Request) { r.AddCookie(session) })); user != "" || err != nil {
+		t.Errorf("session of removed user: %q, %v", user, err)
+	}
+	if user, err := a.authenticate(request(func(r *http.Request) { r.SetBasicAuth("alice", "secret") })); err == nil {
+		t.Errorf("old password accepted for %q after it was changed", user)
+	}
+	if user, err := a.authenticate(request(func(r *http.Request) { r.SetBasicAuth("alice", "changed") })); user != "alice" || err != nil {
+		t.Errorf("new password: %q, %v", user, err)
+	}
+}
+
+func TestPasswordCache(t *testing.T) {
+	var c passwordCache
+	now := time.Unix(1_000_000, 0)
+	c.add("alice", "secret", "$2y$hash", now)
+	tests := []struct {
+		name             string
+		user, pass, hash string
+		after            time.Duration
+		want             bool
+	}{
+		{"cached", "alice", "secret", "$2y$hash", 0, true},
+		{"before expiry", "alice", "secret", "$2y$hash", passwordCacheTTL - time.Second, true},
+		{"expired", "alice", "secret", "$2y$hash", passwordCacheTTL, false},
+		{"other password", "alice", "guess", "$2y$hash", 0, false},
+		{"other user", "bob", "secret", "$2y$hash", 0, false},
+		{"hash changed", "alice", "secret", "$2y$other", 0, false},
+	}
+	for _, tt := range tests {
+		if got := c.has(tt.user, tt.pass, tt.hash, now.Add(tt.after)); got != tt.want {
+			t.Errorf("%s: has = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	c.add("bob", "pw", "$2y$bob", now.Add(passwordCacheTTL+time.Minute))
+	if _, ok := c.entries[passwordKey{"alice", sha256.Sum256([]byte("secret"))}]; ok || len(c.entries) != 1 {
+		t.Errorf("expired entries not swept: %v", c.entries)
+	}
+}
+
+func TestSafeNext(t *testing.T) {
+	a, _ := newTestAuth(t)
+	tests := []struct {
+		root, next, want string
+	}{
+		{"", "", "/"},
+		{"", "/", "/"},
+		{"", "/tree?ref=main&path=a", "/tree?ref=main&path=a"},
+		{"", "//evil.example/", "/"},
+		{"", "/\\evil.example/", "/"},
+		{"", "https://evil.example/", "/"},
+		{"", "evil.example", "/"},
+		{"", "javascript:alert(1)", "/"},
+		{"", `\\evil.example`, "/"},
+		{"/git", "/git/tree", "/git/tree"},
+		{"/git", "/git/", "/git/"},
+		{"/git", "/gitx/tree", "/git/"},
+		{"/git", "/tree", "/git/"},
+		{"/git", "//git/", "/git/"},
+	}
+	for _, tt := range tests {
+		a.root = tt.root
+		if got := a.safeNext(tt.next); got != tt.want {
+			t.Errorf("safeNext(%q) under %q = %q, want %q", tt.next, tt.root, got, tt.want)
+		}
+	}
+}
+
+func TestIsPublic(t *testing.T) {
+	a, _ := newTestAuth(t, "/pages/", "/raw", "/*/archive")
+	tests := map[string]bool{
+		"/static/app.css":    true,
+		"/pages/":            true,
+		"/pages/main/x.html": true,
+		"/pagesx":            false,
+		"/raw":               true,
+		"/raw/x":             false,
+		"/api/archive":       true,
+		"/api/x/archive":     false,
+		"/":                  false,
+		"/tree":              false,
+	}
+	for path, want := range tests {
+		if got := a.isPublic(path); got != want {
+			t.Errorf("isPublic(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestLoginForm(t *testing.T) {
+	a, _ := newTestAuth(t)
+	h := a.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + userFromContext(r.Context())))
+	}))
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	login := func(pass string) *httptest.ResponseRecorder {
+		form := url.Values{"username": {"alice"}, "password": {pass}, "next": {"/tree?ref=main"}}
+		r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return serve(r)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/tree?ref=main", nil)
+	r.Header.Set("Accept", "text/html")
+	if w := serve(r); w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login?next=%2Ftree%3Fref%3Dmain" {
+		t.Errorf("browser without session: %d %q", w.Code, w.Header().Get("Location"))
+	}
+	if w := serve(httptest.NewRequest(http.MethodGet, "/tree", nil)); w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("script without credentials: %d %v", w.Code, w.Header())
+	}
+
+	if w := login("wrong"); w.Code != http.StatusUnauthorized || len(w.Result().Cookies()) != 0 {
+		t.Errorf("wrong password: %d, cookies %v", w.Code, w.Result().Cookies())
+	}
+	w := login("secret")
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/tree?ref=main" {
+		t.Fatalf("login: %d %q", w.Code, w.Header().Get("Location"))
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != sessionCookie || !cookies[0].HttpOnly {
+		t.Fatalf("login cookies: %v", cookies)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/tree", nil)
+	r.AddCookie(cookies[0])
+	if w := serve(r); w.Code != http.StatusOK || w.Body.String() != "hello alice" {
+		t.Errorf("with session: %d %q", w.Code, w.Body)
+	}
+
+	if w := serve(httptest.NewRequest(http.MethodGet, "/logout", nil)); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /logout: %d", w.Code)
+	}
+	r = httptest.NewRequest(http.MethodPost, "/logout", nil)
+	r.AddCookie(cookies[0])
+	w = serve(r)
+	if cookies := w.Result().Cookies(); w.Code != http.StatusSeeOther || len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+		t.Errorf("logout: %d, cookies %v", w.Code, cookies)
+	}
+
+	// A copy of the cookie kept after logging out is no longer accepted.
+	r = httptest.NewRequest(http.MethodGet, "/tree", nil)
+	r.AddCookie(cookies[0])
+	if w := serve(r); w.Code != http.StatusUnauthorized {
+		t.Errorf("session after logout: %d %q", w.Code, w.Body)
+	}
+}
+
+func TestSessionRevocations(t *testing.T) {
+	var rv sessionRevocations
+	now := time.Unix(1_000_000, 0)
+	rv.add("sig1", now.Add(time.Hour), now)
+	if !rv.has("sig1", now) || !rv.has("sig1", now.Add(time.Hour)) {
+		t.Error("revoked session not found")
+	}
+	if rv.has("sig2", now) {
+		t.Error("other session revoked")
+	}
+
+	// Sessions are forgotten once they have expired anyway.
+	rv.add("sig2", now.Add(3*time.Hour), now.Add(2*time.Hour))
+	if _, ok := rv.sigs["sig1"]; ok || len(rv.sigs) != 1 {
+		t.Errorf("expired sessions not swept: %v", rv.sigs)
+	}
+}
+
+func TestLoginThrottle(t *testing.T) {
+	var lt loginThrottle
+	now := time.Unix(1_000_000, 0)
+	for i := 1; i < maxLoginFailures; i++ {
+		if lt.fail("10.0.0.1", now) {
+			t.Fatalf("locked out after %d failures", i)
+		}
+		if w := lt.wait("10.0.0.1", now); w != 0 {
+			t.Fatalf("wait %v after %d failures", w, i)
+		}
+	}
+	if !lt.fail("10.0.0.1", now.Add(time.Minute)) {
+		t.Fatal("not locked out after the last attempt")
+	}
+	if w := lt.wait("10.0.0.1", now.Add(5*time.Minute)); w != loginFailureWindow-5*time.Minute {
+		t.Errorf("wait = %v, want %v", w, loginFailureWindow-5*time.Minute)
+	}
+	if w := lt.wait("10.0.0.2", now); w != 0 {
+		t.Errorf("other client waits %v", w)
+	}
+	if w := lt.wait("10.0.0.1", now.Add(loginFailureWindow)); w != 0 {
+		t.Errorf("wait after the window = %v", w)
+	}
+	// A failure after the window starts a new one.
+	if lt.fail("10.0.0.1", now.Add(loginFailureWindow)) {
+		t.Error("locked out by the first failure of a new window")
+	}
+
+	lt.reset("10.0.0.1")
+	for i := 0; i < maxLoginFailures-1; i++ {
+		lt.fail("10.0.0.1", now)
+	}
+	lt.reset("10.0.0.1")
+	if lt.fail("10.0.0.1", now) {
+		t.Error("failures counted across a successful login")
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	htpasswd := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(htpasswd, []byte("alice:"+string(hash)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tmpls, err := loadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := newAuth(AuthConfig{Htpasswd: htpasswd, SessionSecret: "test"}, "", tmpls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := a.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + userFromContext(r.Context())))
+	}))
+	post := func(client, pass string) *httptest.ResponseRecorder {
+		form := url.Values{"username": {"alice"}, "password": {pass}}
+		r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = client + ":1234"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	basic := func(client, pass string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.SetBasicAuth("alice", pass)
+		r.RemoteAddr = client + ":1234"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := post("10.0.0.1", "secret"); w.Code != http.StatusSeeOther {
+		t.Fatalf("login: %d", w.Code)
+	}
+	for i := 0; i < maxLoginFailures-1; i++ {
+		if w := post("10.0.0.1", "guess"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("failed login %d: %d", i+1, w.Code)
+		}
+	}
+	if w := basic("10.0.0.1", "guess"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("last failed attempt over Basic: %d", w.Code)
+	}
+
+	// Even the right password is refused now, from either side.
+	w := post("10.0.0.1", "secret")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" ||
+		w.Header().Get("Set-Cookie") != "" || !strings.Contains(w.Body.String(), "Too many failed logins") {
+		t.Errorf("locked-out login: %d %v", w.Code, w.Header())
+	}
+	w = basic("10.0.0.1", "secret")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("locked-out Basic request: %d %v", w.Code, w.Header())
+	}
+
+	if w := basic("10.0.0.2", "secret"); w.Code != http.StatusOK || w.Body.String() != "hello alice" {
+		t.Errorf("other client: %d %q", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"log/slog"
+	"net/http"
+	pathpkg "path"
+	"strings"
+)
+
+// PagesIndexData contains data for directory listings and site maps of
+// pages sites. They are served on the pages origin, so they do not use the
+// viewer's layout and bring their own styles.
+type PagesIndexData struct {
+	CSS     template.CSS
+	Site    string // ref the site is served from
+	Prefix  string // URL path of the site root, ending in '/'
+	Path    string // listed directory within the site, "" at the top
+	Parent  string // URL of the parent directory, "" at the top
+	Entries []PagesIndexEntry
+	Sitemap bool
+	Files   []SitemapFile
+}
+
+// PagesIndexEntry is an entry of a directory listing.
+type PagesIndexEntry struct {
+	TreeEntry
+	URL string
+}
+
+// SitemapFile is an HTML page on a site map.
+type SitemapFile struct {
+	Path string // within the site
+	URL  string
+	Size int64
+}
+
+// pagesPublished reports whether the entry at p within the site is
+// published: configuration files are not, nor are files Jekyll leaves out
+// unless the site has a .nojekyll file.
+func (site pagesSite) pagesPublished(p string) bool {
+	return p != "_redirects" && p != "_headers" && (site.nojekyll || !jekyllExcluded(p))
+}
+
+// serveAutoindex lists the directory rel of the site, styled like the tree
+// page. It reports false if rel is not a directory.
+func (s *Server) serveAutoindex(w http.ResponseWriter, r *http.Request, site pagesSite, name, rev, rel string) bool {
+	dir := pathpkg.Join(site.root, rel)
+	if rel != "" && (!site.isDir(dir) || !site.pagesPublished(rel)) {
+		return false
+	}
+	entries, err := gitLsTree(r.Context(), s.repoPath, site.commit, dir)
+	if err != nil {
+		s.httpError(w, r, http.StatusInternalServerError, "Failed to list directory", err)
+		return true
+	}
+	entries = s.filterEntries(r, rev, dir, entries)
+	var published []PagesIndexEntry
+	for _, e := range entries {
+		p := pathpkg.Join(rel, e.Name)
+		if !site.pagesPublished(p) {
+			continue
+		}
+		u := site.prefix + escapePath(p)
+		if e.IsDir() {
+			u += "/"
+		}
+		published = append(published, PagesIndexEntry{TreeEntry: e, URL: u})
+	}
+	data := PagesIndexData{CSS: template.CSS(appCSSContent), Site: name, Prefix: site.prefix, Path: rel, Entries: published}
+	if rel != "" {
+		data.Parent = site.prefix + escapePath(parentPath(rel))
+		if data.Parent != site.prefix {
+			data.Parent += "/"
+		}
+	}
+	s.renderPagesIndex(w, r, data)
+	return true
+}
+
+// serveSitemap lists every published HTML page of the site.
+func (s *Server) serveSitemap(w http.ResponseWriter, r *http.Request, site pagesSite, name, rev string) {
+	files, err := s.siteFiles(r.Context(), site)
+	if err != nil {
+		s.httpError(w, r, http.StatusInternalServerError, "Failed to list site", err)
+		return
+	}
+	aclName := ""
+	if s.acl != nil {
+		aclName = s.aclRef(r.Context(), rev)
+	}
+	data := PagesIndexData{CSS: template.CSS(appCSSContent), Site: name, Prefix: site.prefix, Sitemap: true}
+	for _, e := range files {
+		p := e.Name
+		if !isPage(p) {
+			continue
+		}
+		if s.acl != nil && !s.checkACL(r, aclName, aclPath{path: pathpkg.Join(site.root, p)}) {
+			continue
+		}
+		u := site.prefix + escapePath(p)
+		if base := pathpkg.Base(p); base == "index.html" {
+			u = strings.TrimSuffix(u, base)
+		}
+		data.Files = append(data.Files, SitemapFile{Path: p, URL: u, Size: e.Size})
+	}
+	s.renderPagesIndex(w, r, data)
+}
+
+// siteFiles returns the published files of the site, named by their path
+// within it.
+func (s *Server) siteFiles(ctx context.Context, site pagesSite) ([]TreeEntry, error) {
+	args := []string{"ls-tree", "-r", "-z", "-l", "--end-of-options", site.commit}
+	if site.root != "" {
+		args = append(args, "--", site.root)
+	}
+	out, err := runGitRaw(ctx, s.repoPath, args...)
+	if err != nil {
+		return nil, err
+	}
+	var files []TreeEntry
+	for _, e := range parseLsTree(out) {
+		if site.root != "" {
+			e.Name = strings.TrimPrefix(e.Name, site.root+"/")
+		}
+		if e.Type == "blob" && site.pagesPublished(e.Name) {
+			files = append(files, e)
+		}
+	}
+	return files, nil
+}
+
+// isPage reports whether the file at p is an HTML page.
+func isPage(p string) bool {
+	return strings.HasSuffix(p, ".html") || strings.HasSuffix(p, ".htm")
+}
+
+// renderPagesIndex executes the pagesindex template with the given data.
+func (s *Server) renderPagesIndex(w http.ResponseWriter, r *http.Request, data PagesIndexData) {
+	t, ok := s.tmpls["pagesindex"]
+	if !ok {
+		slog.ErrorContext(r.Context(), "template not found", "template", "pagesindex")
+		http.Error(w, "template not found", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := t.ExecuteTemplate(w, "pagesindex", data); err != nil {
+		slog.ErrorContext(r.Context(), "render template", "template", "pagesindex", "err", err)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	_ "embed"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// pagesSyncParam asks for an HTML page of a site with pagesSyncJS added,
+// so that the compare page can scroll it along with the other side.
+const pagesSyncParam = "gitviewer-sync"
+
+//go:embed static/pagesync.js
+var pagesSyncJS string
+
+// PagesCompareData contains data for the page comparing the sites of two
+// refs, and for its side-by-side view of one page.
+type PagesCompareData struct {
+	BaseData
+	From      string
+	To        string
+	Changes   []PagesChange
+	Unchanged int
+	Path      string // page shown side by side, "" for the list of changes
+	FromURL   string // of Path in the site at From
+	ToURL     string
+}
+
+// PagesChange is a file added, removed or changed between two sites.
+type PagesChange struct {
+	Path   string // within the sites
+	Status string // "added", "removed" or "changed"
+	Page   bool   // whether it is an HTML page
+}
+
+// handlePagesCompare lists the files that differ between the sites of
+// the refs from and to, or shows the page path of both side by side.
+func (s *Server) handlePagesCompare(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	q := r.URL.Query()
+	if q.Get("from") == "" || q.Get("to") == "" {
+		s.httpError(w, r, http.StatusBadRequest, "from and to query parameters are required", nil)
+		return
+	}
+	from, err := s.queryRef(r, "from")
+	if err != nil {
+		s.resolveError(w, r, err)
+		return
+	}
+	to, err := s.queryRef(r, "to")
+	if err != nil {
+		s.resolveError(w, r, err)
+		return
+	}
+	path, err := cleanPath(q.Get("path"))
+	if err != nil {
+		s.resolveError(w, r, err)
+		return
+	}
+
+	// Like a diff, a comparison may touch any path.
+	if !s.allowed(r, from.Name, aclPath{path: aclAll}) || !s.allowed(r, to.Name, aclPath{path: aclAll}) {
+		s.httpError(w, r, http.StatusNotFound, "Unknown ref", nil)
+		return
+	}
+
+	base, err := s.baseData(r, to)
+	if err != nil {
+		s.httpError(w, r, http.StatusInternalServerError, "Failed to load repo metadata", err)
+		return
+	}
+	data := PagesCompareData{BaseData: base, From: from.Name, To: to.Name, Path: path}
+
+	if path != "" {
+		data.FromURL = s.pagesCommitURL(r, from.Commit, path)
+		data.ToURL = s.pagesCommitURL(r, to.Commit, path)
+	} else {
+		oldFiles, err := s.commitSiteFiles(r, from.Commit)
+		if err != nil {
+			s.httpError(w, r, http.StatusInternalServerError, "Failed to list site", err)
+			return
+		}
+		newFiles, err := s.commitSiteFiles(r, to.Commit)
+		if err != nil {
+			s.httpError(w, r, http.StatusInternalServerError, "Failed to list site", err)
+			return
+		}
+		data.Changes, data.Unchanged = comparePagesFiles(oldFiles, newFiles)
+	}
+
+	// The frames show pages from their own origin, or sandboxed from ours.
+	frameSrc := "'self'"
+	if origin := s.pagesOrigin(r); origin != "" {
+		frameSrc = origin
+	}
+	w.Header().Set("Content-Security-Policy", uiCSP+"; frame-src "+frameSrc)
+
+	t, ok := s.tmpls["pagescompare"]
+	if !ok {
+		slog.ErrorContext(ctx, "template not found", "template", "pagescompare")
+		http.Error(w, "template not found", http.StatusInternalServerError)
+		return
+	}
+	if err := t.ExecuteTemplate(w, "pagescompare", data); err != nil {
+		slog.ErrorContext(ctx, "render template", "template", "pagescompare", "err", err)
+	}
+}
+
+// commitSiteFiles returns the object IDs of the published files of the
+// site at commit, by their path within the site.
+func (s *Server) commitSiteFiles(r *http.Request, commit string) (map[string]string, error) {
+	site, err := s.loadPagesSite(r.Context(), commit, "")
+	if err != nil {
+		return nil, err
+	}
+	files, err := s.siteFiles(r.Context(), site)
+	if err != nil {
+		return nil, err
+	}
+	objects := make(map[string]string, len(files))
+	for _, e := range files {
+		objects[e.Name] = e.Object
+	}
+	return objects, nil
+}
+
+// comparePagesFiles returns the changes from the files of one site to
+// those of another, sorted by path, and how many files are unchanged.
+func comparePagesFiles(oldFiles, newFiles map[string]string) ([]PagesChange, int) {
+	var changes []PagesChange
+	unchanged := 0
+	for p, obj := range newFiles {
+		switch old, ok := oldFiles[p]; {
+		case !ok:
+			changes = append(changes, PagesChange{Path: p, Status: "added", Page: isPage(p)})
+		case old != obj:
+			changes = append(changes, PagesChange{Path: p, Status: "changed", Page: isPage(p)})
+		default:
+			unchanged++
+		}
+	}
+	for p := range oldFiles {
+		if _, ok := newFiles[p]; !ok {
+			changes = append(changes, PagesChange{Path: p, Status: "removed", Page: isPage(p)})
+		}
+	}
+	slices.SortFunc(changes, func(a, b PagesChange) int { return strings.Compare(a.Path, b.Path) })
+	return changes, unchanged
+}
+
+// pagesCommitURL returns the URL of the file at path in the site at
+// commit, asking for the script that keeps the compare page's frames in
+// step.
+func (s *Server) pagesCommitURL(r *http.Request, commit, path string) string {
+	u := url.URL{Path: s.basePath + "/pages/~commit/" + commit + "/" + path, RawQuery: pagesSyncParam}
+	return s.pagesOrigin(r) + u.EscapedPath() + "?" + u.RawQuery
+}
+
+// wantsPagesSync reports whether the script of pagesSyncParam should be
+// added to a response of the given type.
+func wantsPagesSync(r *http.Request, contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "text/html" && r.URL.Query().Has(pagesSyncParam)
+}
+
+// bodyEndRE finds the end of an HTML page's body. Matching in place keeps
+// the offsets valid, which lower-casing the page first would not.
+var bodyEndRE = regexp.MustCompile(`(?i)</body>`)
+
+// addPagesSync adds pagesSyncJS to the end of an HTML page's body.
+func addPagesSync(content []byte) []byte {
+	script := []byte("<script>" + pagesSyncJS + "</script>")
+	ends := bodyEndRE.FindAllIndex(content, -1)
+	if len(ends) == 0 {
+		return append(content, script...)
+	}
+	i := ends[len(ends)-1][0]
+	return append(content[:i:i], append(script, content[i:]...)...)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAddPagesSync(t *testing.T) {
+	script := "<script>" + pagesSyncJS + "</script>"
+	tests := []struct {
+		name, page, want string
+	}{
+		{"before body end", "<p>x</p></body></html>", "<p>x</p>" + script + "</body></html>"},
+		{"upper case", "<P>x</P></BODY></HTML>", "<P>x</P>" + script + "</BODY></HTML>"},
+		{"last body end", "<p></body></p></body>", "<p></body></p>" + script + "</body>"},
+		{"no body end", "<p>x</p>", "<p>x</p>" + script},
+		// Lower-casing changes the length of these characters in UTF-8.
+		{"shrinking letters", "<p>ȺȺȺȺȺȺȺȺȺȺ</p></body>", "<p>ȺȺȺȺȺȺȺȺȺȺ</p>" + script + "</body>"},
+		{"growing letters", "<p>İİİİ</p></body>", "<p>İİİİ</p>" + script + "</body>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(addPagesSync([]byte(tt.page)))
+			if got != tt.want {
+				t.Errorf("addPagesSync(%q) = %q, want %q", tt.page, strings.ReplaceAll(got, pagesSyncJS, "…"), strings.ReplaceAll(tt.want, pagesSyncJS, "…"))
+			}
+		})
+	}
+}
+
+func TestComparePagesFiles(t *testing.T) {
+	oldFiles := map[string]string{"index.html": "a", "about.html": "b", "old.css": "c", "same.js": "d"}
+	newFiles := map[string]string{"index.html": "a", "about.html": "B", "new.html": "e", "same.js": "d"}
+	changes, unchanged := comparePagesFiles(oldFiles, newFiles)
+	want := []PagesChange{
+		{Path: "about.html", Status: "changed", Page: true},
+		{Path: "new.html", Status: "added", Page: true},
+		{Path: "old.css", Status: "removed"},
+	}
+	if unchanged != 2 {
+		t.Errorf("unchanged = %d, want 2", unchanged)
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("changes = %v, want %v", changes, want)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Errorf("changes[%d] = %v, want %v", i, changes[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// minCompressSize is the size below which responses are sent as they are:
+// compressing them saves less than it costs.
+const minCompressSize = 1024
+
+// compressibleTypes lists the media types, besides text/* and the +json
+// and +xml suffixes, worth compressing. Most images, fonts in WOFF,
+// archives and media are compressed already.
+var compressibleTypes = map[string]bool{
+	"application/javascript":        true,
+	"application/json":              true,
+	"application/xml":               true,
+	"application/wasm":              true,
+	"application/x-javascript":      true,
+	"application/vnd.ms-fontobject": true,
+	"font/otf":                      true,
+	"font/ttf":                      true,
+	"image/bmp":                     true,
+	"image/svg+xml":                 true,
+	"image/vnd.microsoft.icon":      true,
+	"image/x-icon":                  true,
+}
+
+// brotliLevel is the quality of on-the-fly Brotli compression. Higher
+// levels take several times as long for a few percent less; committed .br
+// copies can use the best one.
+const brotliLevel = 5
+
+// dynamicEncodings are the content codings used to compress responses on
+// the fly, in order of preference.
+var dynamicEncodings = []string{"br", "gzip"}
+
+// precompressedFiles are the extensions of committed precompressed copies
+// of a file, by content coding, in order of preference.
+var precompressedFiles = []struct{ coding, ext string }{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// compressible reports whether content of the given type is worth
+// compressing.
+func compressible(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return strings.HasPrefix(mediaType, "text/") || compressibleTypes[mediaType] ||
+		strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+// withPrecompressed returns paths followed by the paths of their
+// precompressed copies.
+func withPrecompressed(paths []string) []string {
+	out := make([]string, 0, len(paths)*(1+len(precompressedFiles)))
+	out = append(out, paths...)
+	for _, p := range paths {
+		for _, pc := range precompressedFiles {
+			out = append(out, p+pc.ext)
+		}
+	}
+	return out
+}
+
+// encodingQuality returns the q-value that the Accept-Encoding header
+// gives coding, 0 if it does not accept it.
+func encodingQuality(accept, coding string) float64 {
+	q := 0.0
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if name != coding && name != "*" {
+			continue
+		}
+		pq := 1.0
+		for _, p := range params[1:] {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(p), "q="); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					pq = f
+				}
+			}
+		}
+		if name == coding {
+			return pq
+		}
+		q = pq
+	}
+	return q
+}
+
+// chooseEncoding returns the coding among available that the request
+// accepts with the highest quality, earlier ones winning ties, or "" if it
+// accepts none of them.
+func chooseEncoding(r *http.Request, available []string) string {
+	accept := r.Header.Get("Accept-Encoding")
+	best, bestQ := "", 0.0
+	for _, coding := range available {
+		if q := encodingQuality(accept, coding); q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// varyEncoding marks the response as depending on Accept-Encoding.
+func varyEncoding(h http.Header) {
+	for _, v := range h.Values("Vary") {
+		if strings.EqualFold(v, "Accept-Encoding") {
+			return
+		}
+	}
+	h.Add("Vary", "Accept-Encoding")
+}
+
+// writeContent sends content, whose Content-Type must be set, with the
+// given status. Content of a compressible type and at least
+// minCompressSize bytes is compressed with Brotli or gzip, whichever the
+// client prefers.
+func writeContent(w http.ResponseWriter, r *http.Request, status int, content []byte) {
+	h := w.Header()
+	if compressible(h.Get("Content-Type")) && len(content) >= minCompressSize {
+		varyEncoding(h)
+		if coding := chooseEncoding(r, dynamicEncodings); coding != "" {
+			if encoded, err := encode(coding, content); err == nil && len(encoded) < len(content) {
+				content = encoded
+				h.Set("Content-Encoding", coding)
+			}
+		}
+	}
+	h.Set("Content-Length", strconv.Itoa(len(content)))
+	w.WriteHeader(status)
+	_, _ = w.Write(content)
+}
+
+// encode compresses content with coding, one of dynamicEncodings.
+func encode(coding string, content []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var zw io.WriteCloser
+	if coding == "br" {
+		zw = brotli.NewWriterLevel(&buf, brotliLevel)
+	} else {
+		zw = gzip.NewWriter(&buf)
+	}
+	if _, err := zw.Write(content); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writePrecompressed sends content, a committed copy of the response
+// compressed with coding, with the given status.
+func writePrecompressed(w http.ResponseWriter, status int, coding string, content []byte) {
+	h := w.Header()
+	varyEncoding(h)
+	h.Set("Content-Encoding", coding)
+	h.Set("Content-Length", strconv.Itoa(len(content)))
+	w.WriteHeader(status)
+	_, _ = w.Write(content)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestCompressible(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"text/html; charset=utf-8", true},
+		{"text/css", true},
+		{"application/javascript", true},
+		{"application/manifest+json", true},
+		{"application/atom+xml", true},
+		{"image/svg+xml", true},
+		{"image/png", false},
+		{"font/woff2", false},
+		{"application/zip", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := compressible(tt.contentType); got != tt.want {
+			t.Errorf("compressible(%q) = %v, want %v", tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestEncodingQuality(t *testing.T) {
+	tests := []struct {
+		accept, coding string
+		want           float64
+	}{
+		{"", "gzip", 0},
+		{"gzip", "gzip", 1},
+		{"GZIP", "gzip", 1},
+		{"gzip, deflate, br", "br", 1},
+		{"gzip;q=0.5, br;q=0.8", "gzip", 0.5},
+		{"*", "br", 1},
+		{"*;q=0.3", "gzip", 0.3},
+		// A named coding overrides the wildcard in either order.
+		{"gzip;q=0, *", "gzip", 0},
+		{"*, br;q=0", "br", 0},
+		{"identity", "gzip", 0},
+	}
+	for _, tt := range tests {
+		if got := encodingQuality(tt.accept, tt.coding); got != tt.want {
+			t.Errorf("encodingQuality(%q, %q) = %v, want %v", tt.accept, tt.coding, got, tt.want)
+		}
+	}
+}
+
+func TestChooseEncoding(t *testing.T) {
+	available := []string{"br", "gzip"}
+	tests := []struct {
+		accept, want string
+	}{
+		{"", ""},
+		{"gzip, deflate, br", "br"},
+		{"gzip", "gzip"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"br;q=0, gzip;q=0", ""},
+		{"*", "br"},
+		{"deflate", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", tt.accept)
+		if got := chooseEncoding(r, available); got != tt.want {
+			t.Errorf("chooseEncoding(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestWriteContent(t *testing.T) {
+	large := []byte(strings.Repeat("<p>compress me</p>\n", 200))
+	tests := []struct {
+		name, contentType, accept string
+		content                   []byte
+		coding                    string // "" if sent as it is
+		vary                      bool
+	}{
+		{"brotli preferred", "text/html", "gzip, deflate, br", large, "br", true},
+		{"gzip preferred", "text/html", "br;q=0.5, gzip", large, "gzip", true},
+		{"gzip only", "application/json", "gzip", large, "gzip", true},
+		{"brotli only", "text/css", "br", large, "br", true},
+		{"not accepted", "text/html", "deflate", large, "", true},
+		{"small", "text/html", "gzip, br", []byte("<p>hi</p>"), "", false},
+		{"incompressible type", "image/png", "gzip, br", large, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			w.Header().Set("Content-Type", tt.contentType)
+			w.Header().Set("Vary", "Accept-Encoding") // not repeated
+			if !tt.vary {
+				w.Header().Del("Vary")
+			}
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Accept-Encoding", tt.accept)
+			writeContent(w, r, http.StatusNotFound, tt.content)
+
+			if w.Code != http.StatusNotFound {
+				t.Errorf("status %d", w.Code)
+			}
+			if got := w.Header().Values("Vary"); tt.vary && len(got) != 1 || !tt.vary && len(got) != 0 {
+				t.Errorf("Vary = %q", got)
+			}
+			body := w.Body.Bytes()
+			if w.Header().Get("Content-Length") != strconv.Itoa(len(body)) {
+				t.Errorf("Content-Length %s for %d bytes", w.Header().Get("Content-Length"), len(body))
+			}
+			if got := w.Header().Get("Content-Encoding"); got != tt.coding {
+				t.Fatalf("Content-Encoding %q, want %q", got, tt.coding)
+			}
+			var zr io.Reader
+			switch tt.coding {
+			case "":
+				if !bytes.Equal(body, tt.content) {
+					t.Error("content changed")
+				}
+				return
+			case "br":
+				zr = brotli.NewReader(bytes.NewReader(body))
+			case "gzip":
+				gr, err := gzip.NewReader(bytes.NewReader(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				zr = gr
+			}
+			if got, err := io.ReadAll(zr); err != nil || !bytes.Equal(got, tt.content) {
+				t.Errorf("decompressed content differs, err %v", err)
+			}
+		})
+	}
+}
+
+func TestVaryEncoding(t *testing.T) {
+	h := http.Header{"Vary": {"Origin", "accept-encoding"}}
+	varyEncoding(h)
+	if got := h.Values("Vary"); len(got) != 2 {
+		t.Errorf("Vary = %q", got)
+	}
+	h = http.Header{"Vary": {"Origin"}}
+	varyEncoding(h)
+	if got := h.Values("Vary"); len(got) != 2 || got[1] != "Accept-Encoding" {
+		t.Errorf("Vary = %q", got)
+	}
+}
+
+func TestWithPrecompressed(t *testing.T) {
+	got := withPrecompressed([]string{"a.css", "b/index.html"})
+	want := []string{"a.css", "b/index.html", "a.css.br", "a.css.gz", "b/index.html.br", "b/index.html.gz"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("withPrecompressed = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,878 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	pathpkg "path"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds server settings loaded from the config file, environment
+// and command-line flags, in increasing order of precedence.
+//
+// An example config file:
+//
+//	listen = [":8080"]
+//	base_path = "/git" # when served under https://host/git/ by a proxy
+//	trusted_proxies = ["127.0.0.1", "10.0.0.0/8"]
+//	default_ref = "main"
+//	scan = "/srv/git"
+//
+//	[limits]
+//	max_preview = 204800 # bytes shown on the file page
+//	commits_per_page = 50
+//	git_slots = 16       # weighted concurrent git commands
+//	rate_per_minute = 120 # per client IP, 0 disables
+//	rate_burst = 30
+//
+//	[features]
+//	pages = true
+//	workflows = true
+//	clone = false
+//
+//	[[repo]]
+//	path = "/srv/git/api.git"
+//	name = "api"
+//	display_name = "Public API"
+//	description = "REST API server"
+//
+//	[auth]
+//	htpasswd = "/etc/gitviewer/htpasswd"
+//	session_secret = "change me"
+//	public = ["/", "/static/"]
+//
+//	[[token]]
+//	user = "ci"
+//	token = "0123456789abcdef0123"
+//
+//	[groups]
+//	devs = ["alice", "bob"]
+//
+//	[[acl]]
+//	access = "deny"
+//	who = ["@devs"]
+//	refs = ["security/**"]
+//
+//	[[acl]]
+//	access = "allow"
+//	who = ["@authenticated"]
+//
+//	[log]
+//	format = "json"  # or "text"
+//	level = "info"   # debug also logs every git command
+//	access_log = "/var/log/gitviewer/access.log" # Apache combined format
+//	max_size = 100   # MB before the access log is rotated
+//	max_backups = 5
+//
+//	[pages]
+//	host = "pages.git.example.com" # or listen = ":8081"
+//	domain = "preview.git.example.com" # {branch}.preview.git.example.com
+//	cname_hosts = ["*.docs.example.com"] # custom domains branches may claim
+//	spa = true # serve index.html for unknown paths
+//	autoindex = true # list directories without index.html
+//	rewrite = true # for sites built to be served at the root of a domain
+//
+//	[metrics]
+//	enabled = true
+//	listen = "127.0.0.1:9100" # separate address without authentication
+//
+//	[timeouts]
+//	git = "30s"
+//	diff = "1m"
+//	archive = "10m"
+//	queue = "10s"
+//	shutdown = "30s"
+//
+//	[tls]
+//	self_signed = ["git.office.lan", "10.0.0.5"] # or cert and key
+//	http_redirect = ":80"
+//	hsts_max_age = 31536000
+type Config struct {
+	Listen         []string
+	BasePath       string // URL prefix of all pages, "" or e.g. "/git"
+	TrustedProxies []string
+	DefaultRef     string
+	Scan           string
+	MaxPreview     int64
+	CommitsPerPage int
+	GitSlots       int64 // weighted limit on concurrent git commands
+	RatePerMinute  int   // requests per client IP, 0 for no limit
+	RateBurst      int
+	Features       Features
+	Repos          []RepoConfig
+	Auth           AuthConfig
+	Groups         map[string][]string
+	ACL            []ACLRule
+	TLS            TLSConfig
+	Timeouts       Timeouts
+	Metrics        MetricsConfig
+	Pages          PagesConfig
+	Log            LogConfig
+}
+
+// MetricsConfig configures the Prometheus /metrics endpoint. It is served
+// below the base path, behind authentication, unless a separate listen
+// address is given.
+type MetricsConfig struct {
+	Enabled bool
+	Listen  string
+}
+
+// Timeouts limits how long requests and the git commands they run may
+// take. Zero disables a limit.
+type Timeouts struct {
+	Git      time.Duration // most pages
+	Diff     time.Duration
+	Archive  time.Duration
+	Clone    time.Duration
+	Queue    time.Duration // how long a git command may wait for a slot
+	Shutdown time.Duration // grace period for running requests on SIGINT/SIGTERM
+
+	// http.Server settings. Write applies to routes without an operation
+	// timeout above, such as static files and the login page.
+	ReadHeader time.Duration
+	Read       time.Duration
+	Write      time.Duration
+	Idle       time.Duration
+}
+
+// AuthConfig configures authentication. It is enabled as soon as an
+// htpasswd file or an API token is configured.
+type AuthConfig struct {
+	Htpasswd      string
+	SessionSecret string
+	Public        []string // routes reachable without logging in
+	Tokens        []TokenConfig
+}
+
+// TokenConfig maps a bearer API token to a user name.
+type TokenConfig struct {
+	User  string
+	Token string
+}
+
+// minTokenLength is the shortest API token accepted in the config.
+const minTokenLength = 20
+
+// enabled reports whether any authentication method is configured.
+func (a AuthConfig) enabled() bool {
+	return a.Htpasswd != "" || len(a.Tokens) > 0
+}
+
+// Features toggles optional parts of the UI and API.
+type Features struct {
+	Pages     bool
+	Workflows bool
+	Clone     bool
+}
+
+// RepoConfig describes a repository listed in the config file.
+type RepoConfig struct {
+	Path        string
+	Name        string // URL name; defaults to the directory name
+	DisplayName string
+	Description string
+	DefaultRef  string
+}
+
+// defaultConfig returns the settings used when nothing is configured.
+func defaultConfig() *Config {
+	return &Config{
+		Listen:         []string{":8080"},
+		MaxPreview:     200 * 1024, // 200 KiB
+		CommitsPerPage: 50,
+		GitSlots:       int64(4 * runtime.NumCPU()),
+		RateBurst:      30,
+		Features: Features{
+			Pages:     true,
+			Workflows: true,
+		},
+		TLS: TLSConfig{
+			HSTSMaxAge: 365 * 24 * 60 * 60, // one year
+		},
+		Log: LogConfig{
+			Format:     "text",
+			Level:      "info",
+			MaxSizeMB:  100,
+			MaxBackups: 5,
+		},
+		Timeouts: Timeouts{
+			Git:        30 * time.Second,
+			Diff:       time.Minute,
+			Archive:    10 * time.Minute,
+			Clone:      30 * time.Minute,
+			Queue:      10 * time.Second,
+			Shutdown:   30 * time.Second,
+			ReadHeader: 10 * time.Second,
+			Read:       time.Minute,
+			Write:      time.Minute,
+			Idle:       2 * time.Minute,
+		},
+	}
+}
+
+// loadConfigFile reads a TOML config file over the defaults in cfg.
+func loadConfigFile(cfg *Config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	doc, err := parseTOML(string(data))
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	d := &configDecoder{file: path}
+	d.root(cfg, doc)
+	return errors.Join(d.errs...)
+}
+
+// applyEnv overrides cfg with GITVIEWER_* environment variables.
+func applyEnv(cfg *Config) error {
+	var errs []error
+	if v, ok := os.LookupEnv("GITVIEWER_ADDR"); ok {
+		cfg.Listen = splitList(v)
+	}
+	if v, ok := os.LookupEnv("GITVIEWER_BASE_PATH"); ok {
+		cfg.BasePath = v
+	}
+	if v, ok := os.LookupEnv("GITVIEWER_TRUSTED_PROXIES"); ok {
+		cfg.TrustedProxies = splitList(v)
+	}
+	if v, ok := os.LookupEnv("GITVIEWER_DEFAULT_REF"); ok {
+		cfg.DefaultRef = v
+	}
+	if v, ok := os.LookupEnv("GITVIEWER_SCAN"); ok {
+		cfg.Scan = v
+	}
+	if v, ok := os.LookupEnv("GITVIEWER_HTPASSWD"); ok {
+		cfg.Auth.Htpasswd = v
+	}
+	if v, ok := os.LookupEnv("GITVIEWER_SESSION_SECRET"); ok {
+		cfg.Auth.SessionSecret = v
+	}
+	if v, ok := os.LookupEnv("GITVIEWER_TLS_CERT"); ok {
+		cfg.TLS.Cert = v
+	}
+	if v, ok := os.LookupEnv("GITVIEWER_TLS_KEY"); ok {
+		cfg.TLS.Key = v
+	}
+	if v, ok := os.LookupEnv("GITVIEWER_TLS_SELF_SIGNED"); ok {
+		cfg.TLS.SelfSigned = splitList(v)
+	}
+	if v, ok := os.LookupEnv("GITVIEWER_HTTP_REDIRECT"); ok {
+		cfg.TLS.HTTPRedirect = v
+	}
+	if v, ok := os.LookupEnv("GITVIEWER_METRICS_ADDR"); ok {
+		cfg.Metrics.Listen = v
+	}
+	if v, ok := os.LookupEnv("GITVIEWER_PAGES_ADDR"); ok {
+		cfg.Pages.Listen = v
+	}
+	if v, ok := os.LookupEnv("GITVIEWER_PAGES_HOST"); ok {
+		cfg.Pages.Host = v
+	}
+	if v, ok := os.LookupEnv("GITVIEWER_PAGES_DOMAIN"); ok {
+		cfg.Pages.Domain = v
+	}
+	if v, ok := os.LookupEnv("GITVIEWER_PAGES_CNAME_HOSTS"); ok {
+		cfg.Pages.CNAMEHosts = splitList(v)
+	}
+	if v, ok := os.LookupEnv("GITVIEWER_LOG_FORMAT"); ok {
+		cfg.Log.Format = v
+	}
+	if v, ok := os.LookupEnv("GITVIEWER_LOG_LEVEL"); ok {
+		cfg.Log.Level = v
+	}
+	if v, ok := os.LookupEnv("GITVIEWER_ACCESS_LOG"); ok {
+		cfg.Log.AccessLog = v
+	}
+	if v, ok := os.LookupEnv("GITVIEWER_MAX_PREVIEW"); ok {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("GITVIEWER_MAX_PREVIEW: %q is not an integer", v))
+		}
+		cfg.MaxPreview = n
+	}
+	if v, ok := os.LookupEnv("GITVIEWER_COMMITS_PER_PAGE"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("GITVIEWER_COMMITS_PER_PAGE: %q is not an integer", v))
+		}
+		cfg.CommitsPerPage = n
+	}
+	for _, f := range []struct {
+		env string
+		dst *bool
+	}{
+		{"GITVIEWER_PAGES", &cfg.Features.Pages},
+		{"GITVIEWER_WORKFLOWS", &cfg.Features.Workflows},
+		{"GITVIEWER_CLONE", &cfg.Features.Clone},
+		{"GITVIEWER_METRICS", &cfg.Metrics.Enabled},
+		{"GITVIEWER_PAGES_SPA", &cfg.Pages.SPA},
+		{"GITVIEWER_PAGES_AUTOINDEX", &cfg.Pages.Autoindex},
+		{"GITVIEWER_PAGES_REWRITE", &cfg.Pages.Rewrite},
+	} {
+		if v, ok := os.LookupEnv(f.env); ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not a boolean", f.env, v))
+			}
+			*f.dst = b
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validate reports every invalid setting in cfg.
+func (cfg *Config) validate() error {
+	var errs []error
+	if len(cfg.Listen) == 0 {
+		errs = append(errs, errors.New("listen: at least one address is required"))
+	}
+	for _, addr := range cfg.Listen {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			errs = append(errs, fmt.Errorf("listen: invalid address %q: %v", addr, err))
+		}
+	}
+	if cfg.BasePath != "" {
+		if !strings.HasPrefix(cfg.BasePath, "/") || pathpkg.Clean(cfg.BasePath) != cfg.BasePath ||
+			strings.ContainsAny(cfg.BasePath, "?#{}%\\ ") {
+			errs = append(errs, fmt.Errorf("base_path: %q must be a clean absolute path like /git", cfg.BasePath))
+		}
+	}
+	if _, err := parseTrustedProxies(cfg.TrustedProxies); err != nil {
+		errs = append(errs, fmt.Errorf("trusted_proxies: %v", err))
+	}
+	if cfg.MaxPreview <= 0 {
+		errs = append(errs, fmt.Errorf("limits.max_preview: must be positive, got %d", cfg.MaxPreview))
+	}
+	if cfg.CommitsPerPage <= 0 || cfg.CommitsPerPage > 1000 {
+		errs = append(errs, fmt.Errorf("limits.commits_per_page: must be between 1 and 1000, got %d", cfg.CommitsPerPage))
+	}
+	if cfg.GitSlots <= 0 {
+		errs = append(errs, fmt.Errorf("limits.git_slots: must be positive, got %d", cfg.GitSlots))
+	}
+	if cfg.RatePerMinute < 0 {
+		errs = append(errs, fmt.Errorf("limits.rate_per_minute: must not be negative, got %d", cfg.RatePerMinute))
+	}
+	if cfg.RatePerMinute > 0 && cfg.RateBurst < 1 {
+		errs = append(errs, fmt.Errorf("limits.rate_burst: must be at least 1, got %d", cfg.RateBurst))
+	}
+	if cfg.Scan != "" {
+		if fi, err := os.Stat(cfg.Scan); err != nil || !fi.IsDir() {
+			errs = append(errs, fmt.Errorf("scan: %q is not a directory", cfg.Scan))
+		}
+	}
+	names := make(map[string]int)
+	for i, rc := range cfg.Repos {
+		if rc.Path == "" {
+			errs = append(errs, fmt.Errorf("repo[%d]: path is required", i))
+		}
+		if rc.Name == "" {
+			continue
+		}
+		if !repoNamePattern.MatchString(rc.Name) {
+			errs = append(errs, fmt.Errorf("repo[%d]: name %q must only contain letters, digits, '.', '_' and '-'", i, rc.Name))
+		}
+		if j, ok := names[rc.Name]; ok {
+			errs = append(errs, fmt.Errorf("repo[%d]: name %q is already used by repo[%d]", i, rc.Name, j))
+		}
+		names[rc.Name] = i
+	}
+	// The clone URL of repository x is /x.git/, where a repository named
+	// x.git would be served.
+	if cfg.Features.Clone {
+		for i, rc := range cfg.Repos {
+			if j, ok := names[rc.Name+".git"]; ok && rc.Name != "" {
+				errs = append(errs, fmt.Errorf("repo[%d]: name %q clashes with the clone URL of repo[%d] %q; rename one of them or disable clone", j, rc.Name+".git", i, rc.Name))
+			}
+		}
+	}
+	if cfg.Auth.Htpasswd != "" {
+		if _, err := os.Stat(cfg.Auth.Htpasswd); err != nil {
+			errs = append(errs, fmt.Errorf("auth.htpasswd: %v", err))
+		}
+	}
+	for _, p := range cfg.Auth.Public {
+		if !strings.HasPrefix(p, "/") {
+			errs = append(errs, fmt.Errorf("auth.public: %q must start with /", p))
+		} else if _, err := pathpkg.Match(p, ""); err != nil {
+			errs = append(errs, fmt.Errorf("auth.public: invalid pattern %q: %v", p, err))
+		}
+	}
+	for i, rule := range cfg.ACL {
+		if len(rule.Who) == 0 {
+			errs = append(errs, fmt.Errorf("acl[%d]: who is required", i))
+		}
+		for _, w := range rule.Who {
+			g, isGroup := strings.CutPrefix(w, "@")
+			if isGroup && w != whoAuthenticated && w != whoAnonymous {
+				if _, ok := cfg.Groups[g]; !ok {
+					errs = append(errs, fmt.Errorf("acl[%d]: unknown group %q", i, w))
+				}
+			}
+		}
+		for _, pats := range [][]string{rule.Repos, rule.Refs, rule.Paths} {
+			for _, p := range pats {
+				for _, seg := range strings.Split(p, "/") {
+					if _, err := pathpkg.Match(seg, ""); err != nil {
+						errs = append(errs, fmt.Errorf("acl[%d]: invalid pattern %q: %v", i, p, err))
+					}
+				}
+			}
+		}
+	}
+	if (cfg.TLS.Cert == "") != (cfg.TLS.Key == "") {
+		errs = append(errs, errors.New("tls: cert and key must be set together"))
+	}
+	if len(cfg.TLS.SelfSigned) == 0 {
+		for _, f := range []string{cfg.TLS.Cert, cfg.TLS.Key} {
+			if _, err := os.Stat(f); f != "" && err != nil {
+				errs = append(errs, fmt.Errorf("tls: %v", err))
+			}
+		}
+	}
+	if cfg.TLS.HTTPRedirect != "" {
+		if !cfg.TLS.enabled() {
+			errs = append(errs, errors.New("tls.http_redirect: requires a certificate or self_signed host names"))
+		}
+		if _, _, err := net.SplitHostPort(cfg.TLS.HTTPRedirect); err != nil {
+			errs = append(errs, fmt.Errorf("tls.http_redirect: invalid address %q: %v", cfg.TLS.HTTPRedirect, err))
+		}
+	}
+	if cfg.Metrics.Listen != "" {
+		if _, _, err := net.SplitHostPort(cfg.Metrics.Listen); err != nil {
+			errs = append(errs, fmt.Errorf("metrics.listen: invalid address %q: %v", cfg.Metrics.Listen, err))
+		}
+	}
+	if cfg.Pages.Listen != "" {
+		if _, _, err := net.SplitHostPort(cfg.Pages.Listen); err != nil {
+			errs = append(errs, fmt.Errorf("pages.listen: invalid address %q: %v", cfg.Pages.Listen, err))
+		}
+		if cfg.Pages.Host != "" {
+			errs = append(errs, errors.New("pages: listen and host are mutually exclusive"))
+		}
+	}
+	if h := cfg.Pages.Host; h != "" && !validHostname(h) {
+		errs = append(errs, fmt.Errorf("pages.host: must be a host name without port, got %q", h))
+	}
+	if d := cfg.Pages.Domain; d != "" {
+		if !validHostname(d) {
+			errs = append(errs, fmt.Errorf("pages.domain: must be a host name without port, got %q", d))
+		}
+		if strings.EqualFold(d, cfg.Pages.Host) {
+			errs = append(errs, errors.New("pages: host and domain must differ"))
+		}
+	}
+	for _, h := range cfg.Pages.CNAMEHosts {
+		if !validHostname(strings.TrimPrefix(h, "*.")) {
+			errs = append(errs, fmt.Errorf("pages.cname_hosts: must be host names or *.suffixes, got %q", h))
+		}
+	}
+	if cfg.Log.Format != "text" && cfg.Log.Format != "json" {
+		errs = append(errs, fmt.Errorf("log.format: must be \"text\" or \"json\", got %q", cfg.Log.Format))
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Log.Level)); err != nil {
+		errs = append(errs, fmt.Errorf("log.level: must be debug, info, warn or error, got %q", cfg.Log.Level))
+	}
+	if cfg.Log.MaxSizeMB < 0 {
+		errs = append(errs, fmt.Errorf("log.max_size: must not be negative, got %d", cfg.Log.MaxSizeMB))
+	}
+	if cfg.Log.MaxBackups < 0 {
+		errs = append(errs, fmt.Errorf("log.max_backups: must not be negative, got %d", cfg.Log.MaxBackups))
+	}
+	if cfg.TLS.HSTSMaxAge < 0 {
+		errs = append(errs, fmt.Errorf("tls.hsts_max_age: must not be negative, got %d", cfg.TLS.HSTSMaxAge))
+	}
+	for _, t := range []struct {
+		key string
+		d   time.Duration
+	}{
+		{"git", cfg.Timeouts.Git},
+		{"diff", cfg.Timeouts.Diff},
+		{"archive", cfg.Timeouts.Archive},
+		{"clone", cfg.Timeouts.Clone},
+		{"queue", cfg.Timeouts.Queue},
+		{"shutdown", cfg.Timeouts.Shutdown},
+		{"read_header", cfg.Timeouts.ReadHeader},
+		{"read", cfg.Timeouts.Read},
+		{"write", cfg.Timeouts.Write},
+		{"idle", cfg.Timeouts.Idle},
+	} {
+		if t.d < 0 {
+			errs = append(errs, fmt.Errorf("timeouts.%s: must not be negative, got %s", t.key, t.d))
+		}
+	}
+	tokens := make(map[string]int)
+	for i, t := range cfg.Auth.Tokens {
+		if t.User == "" {
+			errs = append(errs, fmt.Errorf("token[%d]: user is required", i))
+		}
+		if len(t.Token) < minTokenLength {
+			errs = append(errs, fmt.Errorf("token[%d]: token must be at least %d characters", i, minTokenLength))
+		}
+		if j, ok := tokens[t.Token]; ok {
+			errs = append(errs, fmt.Errorf("token[%d]: token is already used by token[%d]", i, j))
+		}
+		tokens[t.Token] = i
+	}
+	return errors.Join(errs...)
+}
+
+// splitList splits a comma-separated list, dropping empty items.
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// validHostname reports whether h looks like a host name: no port, path
+// or empty labels.
+func validHostname(h string) bool {
+	return h != "" && !strings.ContainsAny(h, ":/ ") && strings.Trim(h, ".") == h && !strings.Contains(h, "..")
+}
+
+// configDecoder maps a parsed TOML document onto Config, collecting errors
+// with file and line information.
+type configDecoder struct {
+	file string
+	errs []error
+}
+
+func (d *configDecoder) errorf(line int, format string, args ...any) {
+	d.errs = append(d.errs, fmt.Errorf("%s:%d: %s", d.file, line, fmt.Sprintf(format, args...)))
+}
+
+func (d *configDecoder) root(cfg *Config, doc tomlTable) {
+	for _, key := range doc.keys() {
+		val := doc[key]
+		switch key {
+		case "listen":
+			// Accept a single address as well as a list.
+			if s, ok := val.v.(string); ok {
+				cfg.Listen = []string{s}
+			} else {
+				cfg.Listen = d.strings(key, val)
+			}
+		case "base_path":
+			cfg.BasePath = d.string(key, val)
+		case "trusted_proxies":
+			cfg.TrustedProxies = d.strings(key, val)
+		case "default_ref":
+			cfg.DefaultRef = d.string(key, val)
+		case "scan":
+			cfg.Scan = d.string(key, val)
+		case "limits":
+			t := d.table(key, val)
+			for _, k := range t.keys() {
+				v := t[k]
+				switch k {
+				case "max_preview":
+					cfg.MaxPreview = d.int(key+"."+k, v)
+				case "commits_per_page":
+					cfg.CommitsPerPage = int(d.int(key+"."+k, v))
+				case "git_slots":
+					cfg.GitSlots = d.int(key+"."+k, v)
+				case "rate_per_minute":
+					cfg.RatePerMinute = int(d.int(key+"."+k, v))
+				case "rate_burst":
+					cfg.RateBurst = int(d.int(key+"."+k, v))
+				default:
+					d.errorf(v.line, "unknown key %q in [%s]", k, key)
+				}
+			}
+		case "features":
+			t := d.table(key, val)
+			for _, k := range t.keys() {
+				v := t[k]
+				switch k {
+				case "pages":
+					cfg.Features.Pages = d.bool(key+"."+k, v)
+				case "workflows":
+					cfg.Features.Workflows = d.bool(key+"."+k, v)
+				case "clone":
+					cfg.Features.Clone = d.bool(key+"."+k, v)
+				default:
+					d.errorf(v.line, "unknown key %q in [%s]", k, key)
+				}
+			}
+		case "repo":
+			tables, ok := val.v.([]tomlTable)
+			if !ok {
+				d.errorf(val.line, "repo must be declared as [[repo]]")
+				continue
+			}
+			for _, t := range tables {
+				var rc RepoConfig
+				for _, k := range t.keys() {
+					v := t[k]
+					switch k {
+					case "path":
+						rc.Path = d.string("repo.path", v)
+					case "name":
+						rc.Name = d.string("repo.name", v)
+					case "display_name":
+						rc.DisplayName = d.string("repo.display_name", v)
+					case "description":
+						rc.Description = d.string("repo.description", v)
+					case "default_ref":
+						rc.DefaultRef = d.string("repo.default_ref", v)
+					default:
+						d.errorf(v.line, "unknown key %q in [[repo]]", k)
+					}
+				}
+				cfg.Repos = append(cfg.Repos, rc)
+			}
+		case "auth":
+			t := d.table(key, val)
+			for _, k := range t.keys() {
+				v := t[k]
+				switch k {
+				case "htpasswd":
+					cfg.Auth.Htpasswd = d.string(key+"."+k, v)
+				case "session_secret":
+					cfg.Auth.SessionSecret = d.string(key+"."+k, v)
+				case "public":
+					cfg.Auth.Public = d.strings(key+"."+k, v)
+				default:
+					d.errorf(v.line, "unknown key %q in [%s]", k, key)
+				}
+			}
+		case "metrics":
+			t := d.table(key, val)
+			for _, k := range t.keys() {
+				v := t[k]
+				switch k {
+				case "enabled":
+					cfg.Metrics.Enabled = d.bool(key+"."+k, v)
+				case "listen":
+					cfg.Metrics.Listen = d.string(key+"."+k, v)
+				default:
+					d.errorf(v.line, "unknown key %q in [%s]", k, key)
+				}
+			}
+		case "pages":
+			t := d.table(key, val)
+			for _, k := range t.keys() {
+				v := t[k]
+				switch k {
+				case "listen":
+					cfg.Pages.Listen = d.string(key+"."+k, v)
+				case "host":
+					cfg.Pages.Host = d.string(key+"."+k, v)
+				case "domain":
+					cfg.Pages.Domain = d.string(key+"."+k, v)
+				case "cname_hosts":
+					cfg.Pages.CNAMEHosts = d.strings(key+"."+k, v)
+				case "spa":
+					cfg.Pages.SPA = d.bool(key+"."+k, v)
+				case "autoindex":
+					cfg.Pages.Autoindex = d.bool(key+"."+k, v)
+				case "rewrite":
+					cfg.Pages.Rewrite = d.bool(key+"."+k, v)
+				default:
+					d.errorf(v.line, "unknown key %q in [%s]", k, key)
+				}
+			}
+		case "log":
+			t := d.table(key, val)
+			for _, k := range t.keys() {
+				v := t[k]
+				switch k {
+				case "format":
+					cfg.Log.Format = d.string(key+"."+k, v)
+				case "level":
+					cfg.Log.Level = d.string(key+"."+k, v)
+				case "access_log":
+					cfg.Log.AccessLog = d.string(key+"."+k, v)
+				case "max_size":
+					cfg.Log.MaxSizeMB = int(d.int(key+"."+k, v))
+				case "max_backups":
+					cfg.Log.MaxBackups = int(d.int(key+"."+k, v))
+				default:
+					d.errorf(v.line, "unknown key %q in [%s]", k, key)
+				}
+			}
+		case "timeouts":
+			t := d.table(key, val)
+			for _, k := range t.keys() {
+				v := t[k]
+				dst := map[string]*time.Duration{
+					"git":         &cfg.Timeouts.Git,
+					"diff":        &cfg.Timeouts.Diff,
+					"archive":     &cfg.Timeouts.Archive,
+					"clone":       &cfg.Timeouts.Clone,
+					"queue":       &cfg.Timeouts.Queue,
+					"shutdown":    &cfg.Timeouts.Shutdown,
+					"read_header": &cfg.Timeouts.ReadHeader,
+					"read":        &cfg.Timeouts.Read,
+					"write":       &cfg.Timeouts.Write,
+					"idle":        &cfg.Timeouts.Idle,
+				}[k]
+				if dst == nil {
+					d.errorf(v.line, "unknown key %q in [%s]", k, key)
+					continue
+				}
+				*dst = d.duration(key+"."+k, v)
+			}
+		case "tls":
+			t := d.table(key, val)
+			for _, k := range t.keys() {
+				v := t[k]
+				switch k {
+				case "cert":
+					cfg.TLS.Cert = d.string(key+"."+k, v)
+				case "key":
+					cfg.TLS.Key = d.string(key+"."+k, v)
+				case "self_signed":
+					cfg.TLS.SelfSigned = d.strings(key+"."+k, v)
+				case "http_redirect":
+					cfg.TLS.HTTPRedirect = d.string(key+"."+k, v)
+				case "hsts_max_age":
+					cfg.TLS.HSTSMaxAge = int(d.int(key+"."+k, v))
+				default:
+					d.errorf(v.line, "unknown key %q in [%s]", k, key)
+				}
+			}
+		case "groups":
+			t := d.table(key, val)
+			cfg.Groups = make(map[string][]string)
+			for _, k := range t.keys() {
+				cfg.Groups[k] = d.strings("groups."+k, t[k])
+			}
+		case "acl":
+			tables, ok := val.v.([]tomlTable)
+			if !ok {
+				d.errorf(val.line, "acl must be declared as [[acl]]")
+				continue
+			}
+			for _, t := range tables {
+				rule := ACLRule{Repos: []string{"**"}, Refs: []string{"**"}, Paths: []string{"**"}}
+				hasAccess := false
+				for _, k := range t.keys() {
+					v := t[k]
+					switch k {
+					case "access":
+						hasAccess = true
+						switch access := d.string("acl.access", v); access {
+						case "allow", "deny":
+							rule.Allow = access == "allow"
+						default:
+							d.errorf(v.line, "acl.access must be \"allow\" or \"deny\", got %q", access)
+						}
+					case "who":
+						rule.Who = d.strings("acl.who", v)
+					case "repos":
+						rule.Repos = d.strings("acl.repos", v)
+					case "refs":
+						rule.Refs = d.strings("acl.refs", v)
+					case "paths":
+						rule.Paths = d.strings("acl.paths", v)
+					default:
+						d.errorf(v.line, "unknown key %q in [[acl]]", k)
+					}
+				}
+				if !hasAccess {
+					line := val.line
+					if keys := t.keys(); len(keys) > 0 {
+						line = t[keys[0]].line
+					}
+					d.errorf(line, "acl rule %d: access = \"allow\" or \"deny\" is required", len(cfg.ACL))
+				}
+				cfg.ACL = append(cfg.ACL, rule)
+			}
+		case "token":
+			tables, ok := val.v.([]tomlTable)
+			if !ok {
+				d.errorf(val.line, "token must be declared as [[token]]")
+				continue
+			}
+			for _, t := range tables {
+				var tc TokenConfig
+				for _, k := range t.keys() {
+					v := t[k]
+					switch k {
+					case "user":
+						tc.User = d.string("token.user", v)
+					case "token":
+						tc.Token = d.string("token.token", v)
+					default:
+						d.errorf(v.line, "unknown key %q in [[token]]", k)
+					}
+				}
+				cfg.Auth.Tokens = append(cfg.Auth.Tokens, tc)
+			}
+		default:
+			d.errorf(val.line, "unknown key %q", key)
+		}
+	}
+}
+
+func (d *configDecoder) string(key string, v tomlValue) string {
+	s, ok := v.v.(string)
+	if !ok {
+		d.errorf(v.line, "%s must be a string", key)
+	}
+	return s
+}
+
+func (d *configDecoder) int(key string, v tomlValue) int64 {
+	n, ok := v.v.(int64)
+	if !ok {
+		d.errorf(v.line, "%s must be an integer", key)
+	}
+	return n
+}
+
+func (d *configDecoder) bool(key string, v tomlValue) bool {
+	b, ok := v.v.(bool)
+	if !ok {
+		d.errorf(v.line, "%s must be true or false", key)
+	}
+	return b
+}
+
+func (d *configDecoder) duration(key string, v tomlValue) time.Duration {
+	s, ok := v.v.(string)
+	if !ok {
+		d.errorf(v.line, "%s must be a duration string like \"30s\" or \"5m\"", key)
+		return 0
+	}
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		d.errorf(v.line, "%s: invalid duration %q", key, s)
+	}
+	return dur
+}
+
+func (d *configDecoder) strings(key string, v tomlValue) []string {
+	arr, ok := v.v.([]tomlValue)
+	if !ok {
+		d.errorf(v.line, "%s must be a list of strings", key)
+		return nil
+	}
+	out := make([]string, 0, len(arr))
+	for _, item := range arr {
+		out = append(out, d.string(key, item))
+	}
+	return out
+}
+
+func (d *configDecoder) table(key string, v tomlValue) tomlTable {
+	t, ok := v.v.(tomlTable)
+	if !ok {
+		d.errorf(v.line, "%s must be a table, e.g. [%s]", key, key)
+	}
+	return t
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes a config file into a temporary directory and returns
+// its path.
+func writeConfig(t *testing.T, src string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "gitviewer.toml")
+	if err := os.WriteFile(path, []byte(src), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := writeConfig(t, `
+listen = ":9000" # a single address
+default_ref = "trunk"
+base_path = "/git"
+trusted_proxies = ["127.0.0.1", "10.0.0.0/8"]
+
+[limits]
+max_preview = 1_024
+git_slots = 4
+
+[features]
+workflows = false
+clone = true
+
+[timeouts]
+diff = "2m"
+
+[[repo]]
+path = "/srv/git/api.git"
+name = "api"
+display_name = "Public API"
+
+[[repo]]
+path = "/srv/git/web"
+`)
+	cfg := defaultConfig()
+	if err := loadConfigFile(cfg, path); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg.Listen, []string{":9000"}) {
+		t.Errorf("Listen = %q", cfg.Listen)
+	}
+	if cfg.DefaultRef != "trunk" {
+		t.Errorf("DefaultRef = %q", cfg.DefaultRef)
+	}
+	if cfg.BasePath != "/git" {
+		t.Errorf("BasePath = %q", cfg.BasePath)
+	}
+	if !reflect.DeepEqual(cfg.TrustedProxies, []string{"127.0.0.1", "10.0.0.0/8"}) {
+		t.Errorf("TrustedProxies = %q", cfg.TrustedProxies)
+	}
+	if cfg.MaxPreview != 1024 || cfg.GitSlots != 4 {
+		t.Errorf("MaxPreview, GitSlots = %d, %d", cfg.MaxPreview, cfg.GitSlots)
+	}
+	if !cfg.Features.Pages || cfg.Features.Workflows || !cfg.Features.Clone {
+		t.Errorf("Features = %+v", cfg.Features)
+	}
+	want := []RepoConfig{
+		{Path: "/srv/git/api.git", Name: "api", DisplayName: "Public API"},
+		{Path: "/srv/git/web"},
+	}
+	if !reflect.DeepEqual(cfg.Repos, want) {
+		t.Errorf("Repos = %+v, want %+v", cfg.Repos, want)
+	}
+	if cfg.Timeouts.Diff != 2*time.Minute {
+		t.Errorf("Timeouts.Diff = %v", cfg.Timeouts.Diff)
+	}
+	// Keys the file leaves out keep their defaults.
+	if def := defaultConfig(); cfg.CommitsPerPage != def.CommitsPerPage || cfg.Timeouts.Git != def.Timeouts.Git {
+		t.Errorf("CommitsPerPage, Timeouts.Git = %d, %v, want defaults", cfg.CommitsPerPage, cfg.Timeouts.Git)
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	path := writeConfig(t, `listen = ":9000"
+default_ref = 1
+
+[limits]
+max_preview = "4"
+unknown = 1
+
+[features]
+pages = "yes"
+
+[[repo]]
+path = ["/srv"]
+
+[timeouts]
+git = "soon"
+read = 30
+`)
+	err := loadConfigFile(defaultConfig(), path)
+	if err == nil {
+		t.Fatal("loadConfigFile succeeded")
+	}
+	for _, want := range []string{
+		path + ":2: default_ref must be a string",
+		path + ":5: limits.max_preview must be an integer",
+		path + `:6: unknown key "unknown" in [limits]`,
+		path + ":9: features.pages must be true or false",
+		path + ":12: repo.path must be a string",
+		path + `:15: timeouts.git: invalid duration "soon"`,
+		path + `:16: timeouts.read must be a duration string like "30s" or "5m"`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not contain %q", err, want)
+		}
+	}
+
+	path = writeConfig(t, "listen = [\":9000\",\n")
+	if err := loadConfigFile(defaultConfig(), path); err == nil || err.Error() != path+": line 1: array is incomplete" {
+		t.Errorf("syntax error = %v", err)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	t.Setenv("GITVIEWER_ADDR", ":1, :2")
+	t.Setenv("GITVIEWER_DEFAULT_REF", "env")
+	t.Setenv("GITVIEWER_CLONE", "true")
+	t.Setenv("GITVIEWER_BASE_PATH", "/env")
+	cfg := defaultConfig()
+	cfg.DefaultRef = "file"
+	cfg.BasePath = "/file"
+	if err := applyEnv(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg.Listen, []string{":1", ":2"}) || cfg.DefaultRef != "env" || !cfg.Features.Clone {
+		t.Errorf("Listen, DefaultRef, Clone = %q, %q, %v", cfg.Listen, cfg.DefaultRef, cfg.Features.Clone)
+	}
+	if cfg.BasePath != "/env" {
+		t.Errorf("BasePath = %q", cfg.BasePath)
+	}
+
+	t.Setenv("GITVIEWER_MAX_PREVIEW", "lots")
+	t.Setenv("GITVIEWER_PAGES", "maybe")
+	err := applyEnv(defaultConfig())
+	for _, want := range []string{`GITVIEWER_MAX_PREVIEW: "lots" is not an integer`, `GITVIEWER_PAGES: "maybe" is not a boolean`} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("applyEnv = %v, want %q", err, want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := defaultConfig()
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("defaults: %v", err)
+	}
+	cfg.Listen = []string{"8080"}
+	cfg.CommitsPerPage = 0
+	cfg.BasePath = "git/"
+	cfg.TrustedProxies = []string{"proxy"}
+	cfg.Timeouts.Write = -time.Second
+	cfg.Repos = []RepoConfig{{Path: "/a", Name: "x"}, {Name: "bad/name"}, {Path: "/c", Name: "x"}}
+	err := cfg.validate()
+	for _, want := range []string{
+		`listen: invalid address "8080"`,
+		`base_path: "git/" must be a clean absolute path like /git`,
+		`trusted_proxies: invalid IP address "proxy"`,
+		"limits.commits_per_page: must be between 1 and 1000, got 0",
+		"timeouts.write: must not be negative, got -1s",
+		"repo[1]: path is required",
+		`repo[1]: name "bad/name" must only contain`,
+		`repo[2]: name "x" is already used by repo[0]`,
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("validate = %v, want %q", err, want)
+		}
+	}
+}
+
+func TestValidateCloneURLClash(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Repos = []RepoConfig{{Path: "/srv/a", Name: "x"}, {Path: "/srv/b", Name: "y"}, {Path: "/srv/c", Name: "x.git"}}
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("without clone: %v", err)
+	}
+	cfg.Features.Clone = true
+	err := cfg.validate()
+	want := `repo[2]: name "x.git" clashes with the clone URL of repo[0] "x"`
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("validate = %v, want %q", err, want)
+	}
+}
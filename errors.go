@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ErrorData contains data for error pages.
+type ErrorData struct {
+	BaseData
+	Status      int
+	Title       string // status text, e.g. "Not Found"
+	Message     string
+	Suggestions []Suggestion
+	RequestID   string
+}
+
+// Suggestion is a link offered on an error page.
+type Suggestion struct {
+	Text string `json:"text"`
+	URL  string `json:"url"`
+}
+
+// maxRefSuggestions limits how many similar ref names an error page lists.
+const maxRefSuggestions = 3
+
+// errorBase returns the layout data for an error page. Server errors get
+// no branch list, since git may be what failed.
+func (s *Server) errorBase(r *http.Request, status int) BaseData {
+	base := BaseData{
+		Root:          s.cfg.BasePath,
+		Base:          s.basePath,
+		MultiRepo:     s.multiRepo,
+		RepoName:      s.title(),
+		ShowWorkflows: s.cfg.Features.Workflows,
+		User:          userFromContext(r.Context()),
+	}
+	if status >= 500 {
+		return base
+	}
+	ref, err := s.queryRef(r, "ref")
+	if err != nil {
+		def, err := s.resolveDefaultRef(r.Context())
+		if err != nil {
+			return base
+		}
+		if ref, err = s.resolveRef(r.Context(), def); err != nil {
+			return base
+		}
+	}
+	if full, err := s.baseData(r, ref); err == nil {
+		return full
+	}
+	return base
+}
+
+// suggestions returns links that may help after a 404: similar names for
+// an unknown ref, otherwise the parent of a missing path.
+func (s *Server) suggestions(r *http.Request) []Suggestion {
+	overview := Suggestion{Text: "Go to the repository overview", URL: s.basePath + "/"}
+	q := r.URL.Query()
+	for _, key := range []string{"ref", "from", "to"} {
+		ref := q.Get(key)
+		if ref == "" {
+			continue
+		}
+		if _, err := s.queryRef(r, key); !errors.Is(err, errUnknownRef) {
+			continue
+		}
+		var out []Suggestion
+		for _, name := range s.similarRefs(r, ref) {
+			alt := url.Values{}
+			for k, v := range q {
+				alt[k] = v
+			}
+			alt.Set(key, name)
+			out = append(out, Suggestion{
+				Text: fmt.Sprintf("Did you mean %s?", name),
+				URL:  s.basePath + r.URL.Path + "?" + alt.Encode(),
+			})
+		}
+		return append(out, overview)
+	}
+	if path := normalizeRepoPath(q.Get("path")); path != "" {
+		parent := parentPath(path)
+		text := "Go to the parent directory " + parent
+		if parent == "" {
+			text = "Go to the top-level directory"
+		}
+		return []Suggestion{
+			{Text: text, URL: s.basePath + "/tree?" + refPathQuery(q.Get("ref"), parent)},
+			overview,
+		}
+	}
+	return []Suggestion{overview}
+}
+
+// similarRefs returns visible branch and tag names close to ref, closest
+// first.
+func (s *Server) similarRefs(r *http.Request, ref string) []string {
+	names, err := gitRefNames(r.Context(), s.repoPath)
+	if err != nil {
+		return nil
+	}
+	type match struct {
+		name string
+		dist int
+	}
+	var matches []match
+	want := strings.ToLower(ref)
+	for _, name := range names {
+		lower := strings.ToLower(name)
+		dist := editDistance(want, lower)
+		near := dist <= max(2, len(want)/3) ||
+			len(want) >= 3 && (strings.Contains(lower, want) || strings.Contains(want, lower))
+		if near && s.allowed(r, name, aclPath{path: aclAny}) {
+			matches = append(matches, match{name, dist})
+		}
+	}
+	slices.SortStableFunc(matches, func(a, b match) int { return a.dist - b.dist })
+	var out []string
+	for _, m := range matches[:min(len(matches), maxRefSuggestions)] {
+		out = append(out, m.name)
+	}
+	return out
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// writePlainError sends an error page that belongs to no repository, such
+// as one from middleware, through writeError.
+func writePlainError(w http.ResponseWriter, r *http.Request, tmpls map[string]*template.Template, root string, status int, msg string) {
+	writeError(w, r, tmpls, ErrorData{
+		BaseData:  BaseData{Root: root, User: userFromContext(r.Context())},
+		Status:    status,
+		Title:     http.StatusText(status),
+		Message:   msg,
+		RequestID: requestID(r.Context()),
+	})
+}
+
+// writeNotFound answers paths outside all repositories and requests for a
+// repository the user may not see alike, so that hidden repositories
+// cannot be told apart from missing ones.
+func writeNotFound(w http.ResponseWriter, r *http.Request, tmpls map[string]*template.Template, root string, multi bool) {
+	data := ErrorData{
+		BaseData:  BaseData{Root: root, MultiRepo: multi, User: userFromContext(r.Context())},
+		Status:    http.StatusNotFound,
+		Title:     http.StatusText(http.StatusNotFound),
+		Message:   "Page not found",
+		RequestID: requestID(r.Context()),
+	}
+	if multi {
+		data.Suggestions = []Suggestion{{Text: "Go to the list of repositories", URL: root + "/"}}
+	}
+	writeError(w, r, tmpls, data)
+}
+
+// writeError sends an error page through the layout, or JSON or plain
+// text if the client prefers those.
+func writeError(w http.ResponseWriter, r *http.Request, tmpls map[string]*template.Template, data ErrorData) {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Del("Content-Disposition")
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Cache-Control", "no-store")
+
+	switch negotiate(r, "text/html", "application/json", "text/plain") {
+	case "application/json":
+		h.Set("Content-Type", "application/json")
+		w.WriteHeader(data.Status)
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		enc.Encode(struct {
+			Status      int          `json:"status"`
+			Error       string       `json:"error"`
+			Message     string       `json:"message"`
+			RequestID   string       `json:"request_id,omitempty"`
+			Suggestions []Suggestion `json:"suggestions,omitempty"`
+		}{data.Status, data.Title, data.Message, data.RequestID, data.Suggestions})
+		return
+	case "text/html":
+		var buf bytes.Buffer
+		t, ok := tmpls["error"]
+		if !ok {
+			slog.ErrorContext(r.Context(), "template not found", "template", "error")
+			break
+		}
+		if err := t.ExecuteTemplate(&buf, "error", data); err != nil {
+			slog.ErrorContext(r.Context(), "render template", "template", "error", "err", err)
+			break
+		}
+		h.Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(data.Status)
+		buf.WriteTo(w)
+		return
+	}
+
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(data.Status)
+	fmt.Fprintln(w, data.Message)
+	for _, sg := range data.Suggestions {
+		fmt.Fprintf(w, "%s: %s\n", sg.Text, sg.URL)
+	}
+	if data.RequestID != "" {
+		fmt.Fprintf(w, "\nRequest ID: %s\n", data.RequestID)
+	}
+}
+
+// negotiate returns the offered media type the request's Accept header
+// ranks highest, or the first offer if it has no preference.
+func negotiate(r *http.Request, offers ...string) string {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return offers[0]
+	}
+	best, bestQ := offers[0], 0.0
+	for _, offer := range offers {
+		if q := acceptQuality(accept, offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// acceptQuality returns the q-value that the Accept header gives the media
+// type offer, using the most specific matching range.
+func acceptQuality(accept, offer string) float64 {
+	major, _, _ := strings.Cut(offer, "/")
+	q, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		spec := -1
+		switch strings.ToLower(strings.TrimSpace(params[0])) {
+		case offer:
+			spec = 2
+		case major + "/*":
+			spec = 1
+		case "*/*":
+			spec = 0
+		}
+		if spec < 0 || spec < specificity {
+			continue
+		}
+		pq := 1.0
+		for _, p := range params[1:] {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(p), "q="); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					pq = f
+				}
+			}
+		}
+		q, specificity = pq, spec
+	}
+	return q
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAcceptQuality(t *testing.T) {
+	tests := []struct {
+		accept, offer string
+		want          float64
+	}{
+		{"text/html", "text/html", 1},
+		{"text/html", "application/json", 0},
+		{"*/*", "application/json", 1},
+		{"text/*;q=0.5", "text/plain", 0.5},
+		{"text/*;q=0.5, text/plain;q=0.8", "text/plain", 0.8},
+		// The most specific range wins, even with a lower q-value.
+		{"*/*;q=0.9, application/json;q=0.1", "application/json", 0.1},
+		{"TEXT/HTML; q=0.3", "text/html", 0.3},
+		{"application/json;q=0", "application/json", 0},
+		{"text/html;q=bad", "text/html", 1},
+	}
+	for _, tt := range tests {
+		if got := acceptQuality(tt.accept, tt.offer); got != tt.want {
+			t.Errorf("acceptQuality(%q, %q) = %v, want %v", tt.accept, tt.offer, got, tt.want)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	offers := []string{"text/html", "application/json", "text/plain"}
+	tests := []struct {
+		accept, want string
+	}{
+		{"", "text/html"},
+		{"*/*", "text/html"},
+		{"application/json", "application/json"},
+		{"text/plain", "text/plain"},
+		{"text/html;q=0.5, application/json", "application/json"},
+		{"text/*", "text/html"},
+		{"image/png", "text/html"},
+		// curl and browsers
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", "text/html"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		if got := negotiate(r, offers...); got != tt.want {
+			t.Errorf("negotiate(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	tmpls, err := loadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := ErrorData{
+		BaseData:    BaseData{Root: "/git"},
+		Status:      http.StatusNotFound,
+		Title:       "Not Found",
+		Message:     "Unknown ref <x>",
+		Suggestions: []Suggestion{{Text: "Did you mean main?", URL: "/git/tree?ref=main"}},
+		RequestID:   "abc123",
+	}
+	send := func(accept string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		w.Header().Set("Content-Length", "42")
+		w.Header().Set("Content-Disposition", "attachment")
+		r := httptest.NewRequest(http.MethodGet, "/git/tree?ref=x", nil)
+		r.Header.Set("Accept", accept)
+		writeError(w, r, tmpls, data)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Accept %q: status %d", accept, w.Code)
+		}
+		h := w.Header()
+		if h.Get("Content-Length") != "" || h.Get("Content-Disposition") != "" || h.Get("Cache-Control") != "no-store" {
+			t.Errorf("Accept %q: headers %v", accept, h)
+		}
+		return w
+	}
+
+	w := send("text/html")
+	body := w.Body.String()
+	if ct := w.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("HTML content type %q", ct)
+	}
+	for _, want := range []string{"Unknown ref &lt;x&gt;", `href="/git/tree?ref=main"`, "abc123"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("HTML error page lacks %q", want)
+		}
+	}
+
+	w = send("application/json")
+	var got struct {
+		Status      int
+		Error       string
+		Message     string
+		RequestID   string `json:"request_id"`
+		Suggestions []Suggestion
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("JSON error: %v", err)
+	}
+	if got.Status != 404 || got.Error != "Not Found" || got.Message != data.Message || got.RequestID != "abc123" ||
+		len(got.Suggestions) != 1 || got.Suggestions[0] != data.Suggestions[0] {
+		t.Errorf("JSON error = %+v", got)
+	}
+
+	w = send("text/plain")
+	want := "Unknown ref <x>\nDid you mean main?: /git/tree?ref=main\n\nRequest ID: abc123\n"
+	if w.Body.String() != want {
+		t.Errorf("text error = %q, want %q", w.Body.String(), want)
+	}
+}
+
+func TestHiddenRepoLikeMissing(t *testing.T) {
+	tmpls, err := loadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl := newACL(nil, []ACLRule{
+		{Allow: true, Who: []string{"*"}, Repos: []string{"public"}, Refs: []string{"**"}, Paths: []string{"**"}},
+	})
+	cfg := defaultConfig()
+	cfg.BasePath = "/git"
+	hub := &Hub{multi: true, root: cfg.BasePath, tmpls: tmpls}
+	hidden := &Server{repoName: "secret", basePath: "/git/secret", multiRepo: true, tmpls: tmpls, cfg: cfg, acl: acl}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("%s reached the repository", r.URL.Path)
+	})
+
+	for _, accept := range []string{"text/html", "application/json", "text/plain"} {
+		get := func(h http.Handler, path string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, path, nil)
+			r.Header.Set("Accept", accept)
+			h.ServeHTTP(w, r)
+			return w
+		}
+		missing := get(http.HandlerFunc(hub.handleNotFound), "/git/nothing/tree")
+		for name, h := range map[string]http.Handler{"guard": hidden.guard(next), "guardClone": hidden.guardClone(next)} {
+			got := get(h, "/git/secret/tree")
+			if got.Code != missing.Code || got.Body.String() != missing.Body.String() ||
+				got.Header().Get("Content-Type") != missing.Header().Get("Content-Type") {
+				t.Errorf("%s, Accept %q: got %d %q, want %d %q", name, accept, got.Code, got.Body, missing.Code, missing.Body)
+			}
+		}
+	}
+}
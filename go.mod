@@ -1,3 +1,9 @@
 module github.com/SimonWaldherr/gitViewer
 
 go 1.25.4
+
+require (
+	github.com/andybalholm/brotli v1.2.6
+	github.com/pelletier/go-toml/v2 v2.4.3
+	golang.org/x/crypto v0.44.0
+)
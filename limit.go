@@ -0,0 +1,259 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"html/template"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errOverloaded is returned when a git command waited too long for a slot.
+var errOverloaded = errors.New("too many concurrent git commands")
+
+// gitWeights is how many slots a git subcommand occupies. Commands that
+// walk history or produce large output weigh more than object lookups.
+var gitWeights = map[string]int64{
+	"diff":        4,
+	"archive":     4,
+	"upload-pack": 4,
+	"log":         2,
+}
+
+// gitWeight returns the number of slots for the git command with args.
+func gitWeight(args []string) int64 {
+	if len(args) == 0 {
+		return 1
+	}
+	if args[0] == "upload-pack" && slices.Contains(args, "--advertise-refs") {
+		return 1 // only lists refs
+	}
+	if w, ok := gitWeights[args[0]]; ok {
+		return w
+	}
+	return 1
+}
+
+// gitSlots limits concurrent git commands across all repositories. It is
+// set up in main; nil means no limit.
+var gitSlots *gitLimiter
+
+// gitLimiter is a weighted semaphore with a FIFO queue and a limit on how
+// long a command may wait for its slots.
+type gitLimiter struct {
+	size         int64
+	queueTimeout time.Duration
+	after        func(time.Duration) <-chan time.Time // time.After, replaced in tests
+
+	mu       sync.Mutex
+	used     int64
+	waiters  list.List // of *gitWaiter
+	rejected int64     // commands refused after queueTimeout
+}
+
+type gitWaiter struct {
+	n     int64
+	ready chan struct{}
+}
+
+// newGitLimiter returns a limiter with size slots.
+func newGitLimiter(size int64, queueTimeout time.Duration) *gitLimiter {
+	return &gitLimiter{size: size, queueTimeout: queueTimeout, after: time.After}
+}
+
+// acquireGit waits for slots to run the git command with args and returns
+// a function that releases them, records the command's run time and logs
+// the command at debug level.
+func acquireGit(ctx context.Context, args []string) (func(), error) {
+	subcommand := "unknown"
+	if len(args) > 0 {
+		subcommand = args[0]
+	}
+	l := gitSlots
+	var n int64
+	if l != nil {
+		n = min(gitWeight(args), l.size)
+		if err := l.acquire(ctx, n); err != nil {
+			return nil, err
+		}
+	}
+	start := time.Now()
+	return func() {
+		if l != nil {
+			l.release(n)
+		}
+		d := time.Since(start)
+		metrics.observeGit(subcommand, d)
+		slog.DebugContext(ctx, "git", "args", args, "duration", d)
+	}, nil
+}
+
+// acquire takes n slots, waiting in line behind earlier callers.
+func (l *gitLimiter) acquire(ctx context.Context, n int64) error {
+	l.mu.Lock()
+	if l.waiters.Len() == 0 && l.size-l.used >= n {
+		l.used += n
+		l.mu.Unlock()
+		return nil
+	}
+	w := &gitWaiter{n: n, ready: make(chan struct{})}
+	elem := l.waiters.PushBack(w)
+	l.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if l.queueTimeout > 0 {
+		timeout = l.after(l.queueTimeout)
+	}
+	var err error
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timeout:
+		err = errOverloaded
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-w.ready:
+		// Acquired while giving up; hand the slots on.
+		l.used -= n
+	default:
+		l.waiters.Remove(elem)
+	}
+	if err == errOverloaded {
+		l.rejected++
+		slog.WarnContext(ctx, "shedding load", "queued", l.waiters.Len(), "slots_used", l.used, "slots", l.size)
+	}
+	l.notify()
+	return err
+}
+
+// release returns n slots and wakes waiters that now fit.
+func (l *gitLimiter) release(n int64) {
+	l.mu.Lock()
+	l.used -= n
+	l.notify()
+	l.mu.Unlock()
+}
+
+// notify admits waiters from the front of the queue while they fit. It
+// must be called with l.mu held.
+func (l *gitLimiter) notify() {
+	for e := l.waiters.Front(); e != nil; e = l.waiters.Front() {
+		w := e.Value.(*gitWaiter)
+		if l.size-l.used < w.n {
+			return
+		}
+		l.used += w.n
+		l.waiters.Remove(e)
+		close(w.ready)
+	}
+}
+
+// stats returns the slots in use, the number of queued commands and the
+// number of commands rejected so far.
+func (l *gitLimiter) stats() (used int64, queued int, rejected int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.used, l.waiters.Len(), l.rejected
+}
+
+// retryAfter returns the Retry-After value sent with 503 responses.
+func (l *gitLimiter) retryAfter() string {
+	if l == nil || l.queueTimeout <= 0 {
+		return "1"
+	}
+	return strconv.Itoa(int(math.Ceil(l.queueTimeout.Seconds())))
+}
+
+// rateLimiter limits each client to a steady request rate with bursts,
+// using a token bucket per client IP.
+type rateLimiter struct {
+	rate  float64 // tokens per second
+	burst float64
+	root  string // base path of the site, for error pages
+	tmpls map[string]*template.Template
+
+	rejected atomic.Int64
+
+	mu        sync.Mutex
+	clients   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter allows perMinute requests per minute and client, with
+// bursts of up to burst requests. Rejections are rendered with tmpls for
+// the site at root.
+func newRateLimiter(perMinute, burst int, root string, tmpls map[string]*template.Template) *rateLimiter {
+	return &rateLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(burst),
+		root:    root,
+		tmpls:   tmpls,
+		clients: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token for client. If none is left it reports how long
+// until the next one is available.
+func (rl *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.sweep(now)
+	b, ok := rl.clients[client]
+	if !ok {
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.clients[client] = b
+	}
+	b.tokens = min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+}
+
+// sweep forgets clients whose buckets have refilled, at most once a
+// minute. It must be called with rl.mu held.
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < time.Minute {
+		return
+	}
+	rl.lastSweep = now
+	full := time.Duration(rl.burst / rl.rate * float64(time.Second))
+	for c, b := range rl.clients {
+		if now.Sub(b.last) > full {
+			delete(rl.clients, c)
+		}
+	}
+}
+
+// middleware answers 429 Too Many Requests to clients over their rate.
+func (rl *rateLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, wait := rl.allow(clientIP(r), time.Now())
+		if !ok {
+			rl.rejected.Add(1)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writePlainError(w, r, rl.tmpls, rl.root, http.StatusTooManyRequests, "Too many requests, please try again later")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestLimiter returns a limiter whose queue timeout fires only when the
+// returned function is called, once per call.
+func newTestLimiter(size int64) (*gitLimiter, func()) {
+	l := newGitLimiter(size, 1500*time.Millisecond)
+	fire := make(chan time.Time)
+	l.after = func(time.Duration) <-chan time.Time { return fire }
+	return l, func() { fire <- time.Now() }
+}
+
+// waitQueued waits until n commands are queued on l.
+func waitQueued(t *testing.T, l *gitLimiter, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if _, queued, _ := l.stats(); queued == n {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %d queued commands", n)
+}
+
+// checkStats compares l's slots in use, queue length and rejections.
+func checkStats(t *testing.T, l *gitLimiter, used int64, queued int, rejected int64) {
+	t.Helper()
+	if u, q, r := l.stats(); u != used || q != queued || r != rejected {
+		t.Fatalf("stats = %d used, %d queued, %d rejected; want %d, %d, %d", u, q, r, used, queued, rejected)
+	}
+}
+
+func TestGitWeight(t *testing.T) {
+	tests := []struct {
+		args []string
+		want int64
+	}{
+		{nil, 1},
+		{[]string{"cat-file", "-p", "HEAD"}, 1},
+		{[]string{"log", "-n", "20"}, 2},
+		{[]string{"diff", "a", "b"}, 4},
+		{[]string{"archive", "HEAD"}, 4},
+		{[]string{"upload-pack", "--stateless-rpc", "."}, 4},
+		{[]string{"upload-pack", "--stateless-rpc", "--advertise-refs", "."}, 1},
+	}
+	for _, tt := range tests {
+		if got := gitWeight(tt.args); got != tt.want {
+			t.Errorf("gitWeight(%q) = %d, want %d", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestGitLimiterFIFO(t *testing.T) {
+	l, _ := newTestLimiter(4)
+	ctx := context.Background()
+	if err := l.acquire(ctx, 4); err != nil {
+		t.Fatal(err)
+	}
+	checkStats(t, l, 4, 0, 0)
+
+	admitted := make(chan string, 2)
+	go func() {
+		if err := l.acquire(ctx, 2); err == nil {
+			admitted <- "first"
+		}
+	}()
+	waitQueued(t, l, 1)
+	go func() {
+		if err := l.acquire(ctx, 1); err == nil {
+			admitted <- "second"
+		}
+	}()
+	waitQueued(t, l, 2)
+
+	// One free slot would fit the second command, but it may not overtake
+	// the first.
+	l.release(1)
+	checkStats(t, l, 3, 2, 0)
+
+	l.release(1)
+	if got := <-admitted; got != "first" {
+		t.Fatalf("admitted %s command first", got)
+	}
+	checkStats(t, l, 4, 1, 0)
+
+	l.release(2)
+	if got := <-admitted; got != "second" {
+		t.Fatalf("admitted %s command second", got)
+	}
+	checkStats(t, l, 3, 0, 0)
+}
+
+func TestAcquireGitWeights(t *testing.T) {
+	defer func(old *gitLimiter) { gitSlots = old }(gitSlots)
+	l, _ := newTestLimiter(3)
+	gitSlots = l
+	ctx := context.Background()
+
+	releaseLog, err := acquireGit(ctx, []string{"log"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStats(t, l, 2, 0, 0)
+	releaseCat, err := acquireGit(ctx, []string{"cat-file", "-t", "HEAD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStats(t, l, 3, 0, 0)
+	releaseLog()
+	releaseCat()
+	checkStats(t, l, 0, 0, 0)
+
+	// Commands heavier than the whole limiter take all of it instead of
+	// waiting forever.
+	releaseDiff, err := acquireGit(ctx, []string{"diff"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStats(t, l, 3, 0, 0)
+	releaseDiff()
+	checkStats(t, l, 0, 0, 0)
+}
+
+func TestGitLimiterQueueTimeout(t *testing.T) {
+	defer func(old *gitLimiter) { gitSlots = old }(gitSlots)
+	l, timeout := newTestLimiter(1)
+	gitSlots = l
+	if err := l.acquire(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() { done <- l.acquire(context.Background(), 1) }()
+	waitQueued(t, l, 1)
+	timeout()
+	overloaded := <-done
+	if !errors.Is(overloaded, errOverloaded) {
+		t.Fatalf("acquire after queue timeout = %v, want errOverloaded", overloaded)
+	}
+	checkStats(t, l, 1, 0, 1)
+
+	tmpls, err := loadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	(&Server{cfg: defaultConfig(), tmpls: tmpls}).httpError(w, httptest.NewRequest(http.MethodGet, "/log", nil), http.StatusInternalServerError, "Failed", overloaded)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "2" {
+		t.Errorf("overloaded response: %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// A cancelled request leaves the queue without counting as rejected.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { done <- l.acquire(ctx, 1) }()
+	waitQueued(t, l, 1)
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("acquire after cancel = %v", err)
+	}
+	checkStats(t, l, 1, 0, 1)
+}
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(60, 3, "", nil)
+	start := time.Unix(1700000000, 0)
+	allow := func(client string, after time.Duration, want bool, wantWait time.Duration) {
+		t.Helper()
+		ok, wait := rl.allow(client, start.Add(after))
+		if ok != want || wait != wantWait {
+			t.Errorf("allow(%s, +%v) = %v, %v; want %v, %v", client, after, ok, wait, want, wantWait)
+		}
+	}
+
+	// A burst of three, then one request per second.
+	allow("a", 0, true, 0)
+	allow("a", 0, true, 0)
+	allow("a", 0, true, 0)
+	allow("a", 0, false, time.Second)
+	allow("a", 500*time.Millisecond, false, 500*time.Millisecond)
+	allow("a", time.Second, true, 0)
+	allow("a", time.Second, false, time.Second)
+
+	// Clients have separate buckets.
+	allow("b", time.Second, true, 0)
+
+	// Idle time refills the bucket, but only up to the burst.
+	allow("a", time.Hour, true, 0)
+	allow("a", time.Hour, true, 0)
+	allow("a", time.Hour, true, 0)
+	allow("a", time.Hour, false, time.Second)
+}
+
+func TestRateLimiterMiddleware(t *testing.T) {
+	tmpls, err := loadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newRateLimiter(1, 1, "/git", tmpls).middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/git/", nil))
+		if w.Code != want {
+			t.Fatalf("request %d: status %d, want %d", i, w.Code, want)
+		}
+		if want != http.StatusTooManyRequests {
+			continue
+		}
+		if w.Header().Get("Retry-After") != "60" {
+			t.Errorf("Retry-After = %q, want 60", w.Header().Get("Retry-After"))
+		}
+		if !strings.Contains(w.Body.String(), "Too many requests, please try again later") {
+			t.Errorf("429 body = %q", w.Body)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogConfig configures logging. The application log goes to stderr and
+// includes one line per request unless an access log is configured.
+type LogConfig struct {
+	Format     string // "text" or "json"
+	Level      string // "debug", "info", "warn" or "error"
+	AccessLog  string // Apache combined log file, "-" for stdout
+	MaxSizeMB  int    // rotate the access log at this size, 0 never
+	MaxBackups int    // rotated access logs to keep
+}
+
+// newLogger returns the application logger for c, writing to w. Records
+// logged with a request's context carry its request ID.
+func newLogger(c LogConfig, w io.Writer) *slog.Logger {
+	var level slog.Level
+	_ = level.UnmarshalText([]byte(c.Level)) // checked by validate
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	if c.Format == "json" {
+		h = slog.NewJSONHandler(w, opts)
+	} else {
+		h = slog.NewTextHandler(w, opts)
+	}
+	return slog.New(contextHandler{h})
+}
+
+// fatal logs msg at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// contextHandler adds the request ID from the context to every record.
+type contextHandler struct {
+	slog.Handler
+}
+
+// Handle adds the request ID, if any, and passes the record on.
+func (h contextHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if id := requestID(ctx); id != "" {
+		rec.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+// WithAttrs keeps the request ID when attributes are added.
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+// WithGroup keeps the request ID when a group is opened.
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// requestIDKey is the context key under which the request ID is stored.
+type requestIDKey struct{}
+
+// logUserKey is the context key for the *string that the auth middleware
+// fills in, so that the access log can show the user.
+type logUserKey struct{}
+
+// requestID returns the ID of the request ctx belongs to, or "".
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// newRequestID returns a random request ID.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID reports whether an X-Request-Id from a trusted proxy can
+// be used as is.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// setLogUser records the authenticated user for the access log.
+func setLogUser(r *http.Request, user string) {
+	if p, ok := r.Context().Value(logUserKey{}).(*string); ok {
+		*p = user
+	}
+}
+
+// loggingMiddleware gives each request an ID, echoed in the X-Request-Id
+// response header, and logs the request once it is done: in Apache
+// combined format to access if it is set, otherwise to the application log.
+func loggingMiddleware(next http.Handler, access io.Writer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ctx := r.Context()
+		id := requestID(ctx) // set by a trusted proxy
+		if id == "" {
+			id = newRequestID()
+			ctx = context.WithValue(ctx, requestIDKey{}, id)
+		}
+		var user string
+		ctx = context.WithValue(ctx, logUserKey{}, &user)
+		w.Header().Set("X-Request-Id", id)
+		lw := &loggingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(lw, r.WithContext(ctx))
+
+		if access != nil {
+			io.WriteString(access, combinedLogLine(r, user, lw, start))
+			return
+		}
+		slog.LogAttrs(ctx, slog.LevelInfo, "request",
+			slog.String("client", clientIP(r)),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", lw.status),
+			slog.Int64("bytes", lw.bytes),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("user", user),
+		)
+	})
+}
+
+// combinedLogLine formats a request in the Apache combined log format:
+//
+//	%h - %u [%t] "%r" %>s %b "%{Referer}i" "%{User-Agent}i"
+func combinedLogLine(r *http.Request, user string, lw *loggingResponseWriter, start time.Time) string {
+	if user == "" {
+		user = "-"
+	}
+	referer, agent := r.Referer(), r.UserAgent()
+	if referer == "" {
+		referer = "-"
+	}
+	if agent == "" {
+		agent = "-"
+	}
+	size := "-"
+	if lw.bytes > 0 {
+		size = strconv.FormatInt(lw.bytes, 10)
+	}
+	return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s \"%s\" \"%s\"\n",
+		clientIP(r), logEscape(user), start.Format("02/Jan/2006:15:04:05 -0700"),
+		logEscape(r.Method), logEscape(r.RequestURI), logEscape(r.Proto),
+		lw.status, size, logEscape(referer), logEscape(agent))
+}
+
+// logEscape escapes quotes, backslashes and non-printable bytes the way
+// Apache does, so that a field cannot break the log line.
+func logEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// loggingResponseWriter wraps http.ResponseWriter to capture the status
+// code and response size.
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+// WriteHeader captures the status code before writing headers.
+func (w *loggingResponseWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write counts the bytes of the response body.
+func (w *loggingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// rotatingFile is an append-only log file. Once it reaches maxSize bytes
+// it is renamed to path.1, older files shift to path.2 and so on, and
+// files beyond maxBackups are removed.
+type rotatingFile struct {
+	path       string
+	maxSize    int64 // 0 never rotates
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// openRotatingFile opens path for appending.
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+// open (re)opens the file. It must be called with rf.mu held.
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size = f, fi.Size()
+	return nil
+}
+
+// Write appends p, rotating the file first if p would not fit.
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			slog.Error("rotate access log", "path", rf.path, "err", err)
+		}
+	}
+	if rf.f == nil {
+		if err := rf.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the backups and starts a new file. It must be called with
+// rf.mu held.
+func (rf *rotatingFile) rotate() error {
+	rf.f.Close()
+	rf.f = nil
+	if rf.maxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", rf.path, rf.maxBackups))
+	}
+	for i := rf.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+	}
+	var err error
+	if rf.maxBackups > 0 {
+		err = os.Rename(rf.path, rf.path+".1")
+	} else {
+		err = os.Remove(rf.path)
+	}
+	if openErr := rf.open(); err == nil {
+		err = openErr
+	}
+	return err
+}
+
+// reopen closes and reopens the file, for use after external log rotation.
+func (rf *rotatingFile) reopen() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f != nil {
+		rf.f.Close()
+		rf.f = nil
+	}
+	return rf.open()
+}
+
+// Close closes the file.
+func (rf *rotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return nil
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	return err
+}
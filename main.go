@@ -5,24 +5,38 @@
 //
 // Usage:
 //
-//	gitViewer [-addr :8080] [repo]
+//	gitViewer [-addr :8080] [-clone] [-scan dir] [-tls-self-signed host] [repo ...]
 //
 // If no repo path is provided, the current working directory is used.
+// With several repo paths or -scan, all repositories are served from one
+// instance under /{repo}/ with an index page at /.
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"embed"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
+	"io"
 	"io/fs"
-	"log"
+	"log/slog"
 	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"os/exec"
+	"os/signal"
+	pathpkg "path"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -37,32 +51,116 @@ var appJSContent string
 
 // Server serves a Git repository over HTTP.
 type Server struct {
-	repoPath string
-	repoName string
-	tmpls    map[string]*template.Template
+	repoPath  string
+	repoName  string
+	basePath  string // URL prefix of the repository's pages, "" at the root
+	multiRepo bool   // served alongside other repositories
+	bare      bool   // repository has no worktree
+	tmpls     map[string]*template.Template
+	cfg       *Config
+	cnames    cnameCache // custom domains of branch sites
+	acl       *ACL       // nil allows everything
+
+	// Per-repository settings from the config file.
+	displayName string
+	description string
+	defaultRef  string
 }
 
 // BaseData contains fields shared by all page templates.
 type BaseData struct {
+	Root          string // URL prefix of the whole site, "" unless a base path is configured
+	Base          string // URL prefix for links to the current repository
+	MultiRepo     bool   // whether a repository index exists at /
 	RepoName      string
 	Ref           string
+	Commit        string // full object ID Ref resolved to
 	Branches      []string
 	HasGHPages    bool     // Kept for backward compatibility
 	PagesBranches []string // All branches available for pages viewing
+	PagesOrigin   string   // scheme and host of pages, "" if served by the viewer
+	pagesVhost    string   // URL of branch sites with * for the branch label, if any
+	ShowWorkflows bool
+	User          string // authenticated user, "" if anonymous
+}
+
+// PagesURL returns the URL of branch's site.
+func (d BaseData) PagesURL(branch string) string {
+	if d.pagesVhost != "" {
+		return strings.Replace(d.pagesVhost, "*", branchLabel(branch), 1)
+	}
+	return d.PagesOrigin + d.Base + "/pages/" + branch + "/"
 }
 
 // IndexData contains data for the overview page.
 type IndexData struct {
 	BaseData
-	HeadHash string
+	HeadHash    string
+	Bare        bool
+	Description string
+	CloneURL    string // empty unless cloning over HTTP is enabled
 }
 
+// Git tree entry modes with special meaning.
+const (
+	modeExecutable = "100755"
+	modeSymlink    = "120000"
+	modeGitlink    = "160000"
+)
+
 // TreeEntry represents a single entry in a Git tree.
 type TreeEntry struct {
-	Name string
-	Mode string
-	Type string // "blob" or "tree"
-	Size int64
+	Name   string
+	Mode   string
+	Type   string // "blob", "tree" or "commit" (submodule)
+	Object string
+	Size   int64
+
+	// Symlink fields: the raw target stored in the blob and, if it stays
+	// inside the repository, the resolved repository path.
+	Target     string
+	TargetPath string
+
+	// Submodule fields: the URL from .gitmodules and whether a checkout
+	// exists locally so the submodule can be browsed in place.
+	SubmoduleURL   string
+	SubmoduleLocal bool
+}
+
+// IsDir reports whether the entry is a directory.
+func (e TreeEntry) IsDir() bool { return e.Type == "tree" }
+
+// IsSymlink reports whether the entry is a symbolic link.
+func (e TreeEntry) IsSymlink() bool { return e.Mode == modeSymlink }
+
+// IsSubmodule reports whether the entry is a submodule gitlink.
+func (e TreeEntry) IsSubmodule() bool { return e.Mode == modeGitlink }
+
+// IsExecutable reports whether the entry is a file with the executable bit set.
+func (e TreeEntry) IsExecutable() bool { return e.Mode == modeExecutable }
+
+// Kind returns a short human-readable type for the entry.
+func (e TreeEntry) Kind() string {
+	switch {
+	case e.IsDir():
+		return "dir"
+	case e.IsSubmodule():
+		return "submodule"
+	case e.IsSymlink():
+		return "symlink"
+	case e.IsExecutable():
+		return "executable"
+	default:
+		return "file"
+	}
+}
+
+// ShortObject returns the abbreviated object ID of the entry.
+func (e TreeEntry) ShortObject() string {
+	if len(e.Object) > 7 {
+		return e.Object[:7]
+	}
+	return e.Object
 }
 
 // TreeData contains data for the tree browser page.
@@ -76,9 +174,13 @@ type TreeData struct {
 // BlobData contains data for the file viewer page.
 type BlobData struct {
 	BaseData
-	Path      string
-	Content   string
-	Truncated bool
+	Path       string
+	Content    string
+	Truncated  bool
+	Executable bool
+	Symlink    bool
+	Target     string // symlink target as stored in the repository
+	TargetPath string // resolved repository path of the symlink target
 }
 
 // CommitsData contains data for the commit list page.
@@ -110,38 +212,374 @@ type WorkflowsData struct {
 }
 
 func main() {
-	addr := flag.String("addr", ":8080", "HTTP listen address")
+	configPath := flag.String("config", os.Getenv("GITVIEWER_CONFIG"), "path to a TOML config file")
+	addr := flag.String("addr", ":8080", "HTTP listen address(es), comma-separated")
+	clone := flag.Bool("clone", false, "allow read-only git clone/fetch over HTTP")
+	scan := flag.String("scan", "", "serve every repository found in this directory")
+	basePath := flag.String("base-path", "", "URL prefix when served below a path by a reverse proxy, e.g. /git")
+	trustedProxies := flag.String("trusted-proxies", "", "comma-separated proxy IPs/CIDRs whose X-Forwarded-* headers are trusted")
+	defaultRef := flag.String("default-ref", "", "ref shown when none is given (default HEAD)")
+	maxPreview := flag.Int64("max-preview", 200*1024, "maximum number of bytes shown on the file page")
+	commits := flag.Int("commits", 50, "number of commits shown on the commits page")
+	htpasswd := flag.String("htpasswd", "", "require login against this htpasswd file (bcrypt)")
+	tlsCert := flag.String("tls-cert", "", "serve HTTPS with this PEM certificate")
+	tlsKey := flag.String("tls-key", "", "PEM private key for -tls-cert")
+	selfSigned := flag.String("tls-self-signed", "", "serve HTTPS with a generated certificate for these comma-separated host names")
+	httpRedirect := flag.String("http-redirect", "", "plain HTTP address that redirects to HTTPS, e.g. :80")
+	metricsAddr := flag.String("metrics-addr", "", "serve Prometheus metrics at /metrics on this separate address")
+	logFormat := flag.String("log-format", "text", "log format: text or json")
+	logLevel := flag.String("log-level", "info", "log level: debug, info, warn or error")
+	pagesAddr := flag.String("pages-addr", "", "serve branch pages on this separate address, their own origin")
+	pagesHost := flag.String("pages-host", "", "serve branch pages to requests for this host name, their own origin")
+	pagesDomain := flag.String("pages-domain", "", "serve each branch at {branch}.{domain}, e.g. pages.localhost")
+	pagesAutoindex := flag.Bool("pages-autoindex", false, "list directories of branch pages that have no index.html")
+	pagesSPA := flag.Bool("pages-spa", false, "serve index.html for unknown paths of branch pages")
+	pagesRewrite := flag.Bool("pages-rewrite", false, "point root-relative URLs in branch pages below their /pages/ prefix")
+	accessLog := flag.String("access-log", "", "write requests in Apache combined format to this file, - for stdout")
 	flag.Parse()
 
-	repoPath := "."
+	// Collect every configuration problem so they can be fixed in one go.
+	var cfgErrs []error
+	cfg := defaultConfig()
+	if *configPath != "" {
+		cfgErrs = append(cfgErrs, loadConfigFile(cfg, *configPath))
+	}
+	cfgErrs = append(cfgErrs, applyEnv(cfg))
+	// Flags only override settings when given explicitly.
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "addr":
+			cfg.Listen = splitList(*addr)
+		case "clone":
+			cfg.Features.Clone = *clone
+		case "scan":
+			cfg.Scan = *scan
+		case "base-path":
+			cfg.BasePath = *basePath
+		case "trusted-proxies":
+			cfg.TrustedProxies = splitList(*trustedProxies)
+		case "default-ref":
+			cfg.DefaultRef = *defaultRef
+		case "max-preview":
+			cfg.MaxPreview = *maxPreview
+		case "commits":
+			cfg.CommitsPerPage = *commits
+		case "htpasswd":
+			cfg.Auth.Htpasswd = *htpasswd
+		case "tls-cert":
+			cfg.TLS.Cert = *tlsCert
+		case "tls-key":
+			cfg.TLS.Key = *tlsKey
+		case "tls-self-signed":
+			cfg.TLS.SelfSigned = splitList(*selfSigned)
+		case "http-redirect":
+			cfg.TLS.HTTPRedirect = *httpRedirect
+		case "metrics-addr":
+			cfg.Metrics.Listen = *metricsAddr
+		case "pages-addr":
+			cfg.Pages.Listen = *pagesAddr
+		case "pages-host":
+			cfg.Pages.Host = *pagesHost
+		case "pages-domain":
+			cfg.Pages.Domain = *pagesDomain
+		case "pages-autoindex":
+			cfg.Pages.Autoindex = *pagesAutoindex
+		case "pages-spa":
+			cfg.Pages.SPA = *pagesSPA
+		case "pages-rewrite":
+			cfg.Pages.Rewrite = *pagesRewrite
+		case "log-format":
+			cfg.Log.Format = *logFormat
+		case "log-level":
+			cfg.Log.Level = *logLevel
+		case "access-log":
+			cfg.Log.AccessLog = *accessLog
+		}
+	})
 	if flag.NArg() > 0 {
-		repoPath = flag.Arg(0)
+		cfg.Repos = nil
+		for _, p := range flag.Args() {
+			cfg.Repos = append(cfg.Repos, RepoConfig{Path: p})
+		}
+	}
+	if len(cfg.Repos) == 0 && cfg.Scan == "" {
+		cfg.Repos = []RepoConfig{{Path: "."}}
+	}
+	cfg.BasePath = strings.TrimSuffix(cfg.BasePath, "/")
+	cfgErrs = append(cfgErrs, cfg.validate())
+	if err := errors.Join(cfgErrs...); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%v\n", err)
+		os.Exit(1)
+	}
+	slog.SetDefault(newLogger(cfg.Log, os.Stderr))
+	var access io.Writer
+	switch cfg.Log.AccessLog {
+	case "":
+	case "-":
+		access = os.Stdout
+	default:
+		f, err := openRotatingFile(cfg.Log.AccessLog, int64(cfg.Log.MaxSizeMB)<<20, cfg.Log.MaxBackups)
+		if err != nil {
+			fatal("open access log", "err", err)
+		}
+		defer f.Close()
+		access = f
+		// SIGHUP reopens the file after it was moved by logrotate.
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := f.reopen(); err != nil {
+					slog.Error("reopen access log", "path", cfg.Log.AccessLog, "err", err)
+				}
+			}
+		}()
 	}
 
-	srv, err := newServer(repoPath)
+	gitSlots = newGitLimiter(cfg.GitSlots, cfg.Timeouts.Queue)
+	tmpls, err := loadTemplates()
 	if err != nil {
-		log.Fatalf("init server: %v", err)
+		fatal("load templates", "err", err)
+	}
+	acl := newACL(cfg.Groups, cfg.ACL)
+	var repos []*Server
+	for _, rc := range cfg.Repos {
+		srv, err := newServer(rc.Path, tmpls)
+		if err != nil {
+			fatal("open repository", "path", rc.Path, "err", err)
+		}
+		srv.configure(cfg, rc)
+		srv.acl = acl
+		repos = append(repos, srv)
+	}
+	if cfg.Scan != "" {
+		scanned, err := scanRepos(cfg.Scan)
+		if err != nil {
+			fatal("scan repositories", "dir", cfg.Scan, "err", err)
+		}
+		for _, p := range scanned {
+			srv, err := newServer(p, tmpls)
+			if err != nil {
+				slog.Warn("skipping repository", "path", p, "err", err)
+				continue
+			}
+			srv.configure(cfg, RepoConfig{Path: p})
+			srv.acl = acl
+			repos = append(repos, srv)
+		}
+	}
+	hub, err := newHub(repos, tmpls, cfg.Scan != "")
+	if err != nil {
+		fatal("init server", "err", err)
+	}
+	for _, srv := range hub.repos {
+		slog.Info("serving repository", "path", srv.repoPath, "url", srv.basePath+"/")
+	}
+
+	handler := hub.routes()
+	pages := hub.pagesRoutes()
+	vhosts := hub.vhostRoutes()
+	auth, err := newAuth(cfg.Auth, cfg.BasePath, tmpls)
+	if err != nil {
+		fatal("init auth", "err", err)
+	}
+	if auth != nil {
+		handler = auth.middleware(handler)
+		pages = auth.pagesMiddleware(pages)
+		vhosts = auth.vhostMiddleware(vhosts)
+	}
+	handler = securityHeaders(handler)
+	if cfg.Pages.Host != "" || cfg.Pages.Domain != "" || len(cfg.Pages.CNAMEHosts) > 0 {
+		handler = pagesByHost(cfg.Pages, pages, vhosts, handler)
 	}
 
-	log.Printf("Serving %q on http://%s", srv.repoPath, *addr)
-	if err := http.ListenAndServe(*addr, loggingMiddleware(srv.routes())); err != nil {
-		log.Fatal(err)
+	// The viewer and the pages origin share everything from here out.
+	var wrappers []func(http.Handler) http.Handler
+	var tlsConfig *tls.Config
+	if cfg.TLS.enabled() {
+		if tlsConfig, err = loadTLS(cfg.TLS); err != nil {
+			fatal("init tls", "err", err)
+		}
+		if cfg.TLS.HSTSMaxAge > 0 {
+			wrappers = append(wrappers, func(h http.Handler) http.Handler { return hstsMiddleware(h, cfg.TLS.HSTSMaxAge) })
+		}
+	}
+	if cfg.RatePerMinute > 0 {
+		rl := newRateLimiter(cfg.RatePerMinute, cfg.RateBurst, cfg.BasePath, tmpls)
+		metrics.rateLimiter = rl
+		wrappers = append(wrappers, rl.middleware)
+	}
+	wrappers = append(wrappers, instrument, func(h http.Handler) http.Handler { return loggingMiddleware(h, access) })
+	if len(cfg.TrustedProxies) > 0 {
+		trusted, _ := parseTrustedProxies(cfg.TrustedProxies) // checked by validate
+		wrappers = append(wrappers, func(h http.Handler) http.Handler { return proxyHeaders(h, trusted) })
+	}
+	for _, wrap := range wrappers {
+		handler = wrap(handler)
+		pages = wrap(pages)
+	}
+
+	// Requests, and the git commands they run, are cancelled through
+	// baseCtx if they outlast the shutdown grace period.
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	newHTTPServer := func(addr string, h http.Handler) *http.Server {
+		return &http.Server{
+			Addr:              addr,
+			Handler:           h,
+			TLSConfig:         tlsConfig,
+			ReadHeaderTimeout: cfg.Timeouts.ReadHeader,
+			ReadTimeout:       cfg.Timeouts.Read,
+			WriteTimeout:      cfg.Timeouts.Write,
+			IdleTimeout:       cfg.Timeouts.Idle,
+			BaseContext:       func(net.Listener) context.Context { return baseCtx },
+		}
+	}
+	var servers []*http.Server
+	errc := make(chan error, len(cfg.Listen)+3)
+	for _, a := range cfg.Listen {
+		srv := newHTTPServer(a, handler)
+		servers = append(servers, srv)
+		if tlsConfig == nil {
+			slog.Info("listening", "url", "http://"+a)
+			go func() { errc <- srv.ListenAndServe() }()
+		} else {
+			slog.Info("listening", "url", "https://"+a)
+			go func() { errc <- srv.ListenAndServeTLS("", "") }()
+		}
+	}
+	if cfg.Pages.Listen != "" {
+		srv := newHTTPServer(cfg.Pages.Listen, pages)
+		servers = append(servers, srv)
+		if tlsConfig == nil {
+			slog.Info("serving pages", "url", "http://"+cfg.Pages.Listen)
+			go func() { errc <- srv.ListenAndServe() }()
+		} else {
+			slog.Info("serving pages", "url", "https://"+cfg.Pages.Listen)
+			go func() { errc <- srv.ListenAndServeTLS("", "") }()
+		}
 	}
+	if cfg.Metrics.Listen != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", handleMetrics)
+		srv := newHTTPServer(cfg.Metrics.Listen, mux)
+		srv.TLSConfig = nil
+		servers = append(servers, srv)
+		slog.Info("serving metrics", "url", "http://"+cfg.Metrics.Listen+"/metrics")
+		go func() { errc <- srv.ListenAndServe() }()
+	}
+	if cfg.TLS.HTTPRedirect != "" {
+		_, port, _ := net.SplitHostPort(cfg.Listen[0])
+		slog.Info("redirecting to HTTPS", "url", "http://"+cfg.TLS.HTTPRedirect)
+		srv := newHTTPServer(cfg.TLS.HTTPRedirect, loggingMiddleware(redirectToHTTPS(port), access))
+		srv.TLSConfig = nil
+		servers = append(servers, srv)
+		go func() { errc <- srv.ListenAndServe() }()
+	}
+
+	stop, cancelStop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancelStop()
+	select {
+	case err := <-errc:
+		fatal("serve", "err", err)
+	case <-stop.Done():
+	}
+	cancelStop() // a second signal exits immediately
+	slog.Info("shutting down, waiting for running requests", "timeout", cfg.Timeouts.Shutdown)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Shutdown)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Go(func() {
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				slog.Warn("cancelling running requests", "addr", srv.Addr, "err", err)
+				cancelRequests()
+				srv.Close()
+			}
+		})
+	}
+	wg.Wait()
 }
 
 // newServer constructs a Server for the given repository path.
-func newServer(repoPath string) (*Server, error) {
+func newServer(repoPath string, tmpls map[string]*template.Template) (*Server, error) {
+	ctx := context.Background()
 	abs, err := filepath.Abs(repoPath)
 	if err != nil {
 		return nil, fmt.Errorf("resolve path: %w", err)
 	}
-	top, err := runGit(strings.TrimSpace(abs), "rev-parse", "--show-toplevel")
+	abs = strings.TrimSpace(abs)
+	bare, err := runGit(ctx, abs, "rev-parse", "--is-bare-repository")
+	if err != nil {
+		return nil, fmt.Errorf("not a git repo (rev-parse --is-bare-repository failed): %w", err)
+	}
+
+	// Bare repositories have no worktree; git commands run in the git
+	// directory itself and the name drops the conventional .git suffix.
+	if strings.TrimSpace(bare) == "true" {
+		gitDir, err := runGit(ctx, abs, "rev-parse", "--absolute-git-dir")
+		if err != nil {
+			return nil, fmt.Errorf("resolve git dir: %w", err)
+		}
+		gitDir = strings.TrimSpace(gitDir)
+		return &Server{
+			repoPath: gitDir,
+			repoName: strings.TrimSuffix(filepath.Base(gitDir), ".git"),
+			bare:     true,
+			tmpls:    tmpls,
+		}, nil
+	}
+
+	top, err := runGit(ctx, abs, "rev-parse", "--show-toplevel")
 	if err != nil {
 		return nil, fmt.Errorf("not a git repo (rev-parse --show-toplevel failed): %w", err)
 	}
 	top = strings.TrimSpace(top)
 	repoName := filepath.Base(top)
 
+	return &Server{
+		repoPath: top,
+		repoName: repoName,
+		tmpls:    tmpls,
+	}, nil
+}
+
+// configure applies the shared config and the repository's own settings.
+func (s *Server) configure(cfg *Config, rc RepoConfig) {
+	s.cfg = cfg
+	if rc.Name != "" {
+		s.repoName = rc.Name
+	}
+	s.displayName = rc.DisplayName
+	s.description = rc.Description
+	s.defaultRef = rc.DefaultRef
+	if s.defaultRef == "" {
+		s.defaultRef = cfg.DefaultRef
+	}
+}
+
+// title returns the name shown for the repository in the UI.
+func (s *Server) title() string {
+	if s.displayName != "" {
+		return s.displayName
+	}
+	return s.repoName
+}
+
+// resolveDefaultRef returns the ref to show when a request names none: the
+// configured default ref if it exists in this repository, otherwise HEAD.
+func (s *Server) resolveDefaultRef(ctx context.Context) (string, error) {
+	if s.defaultRef != "" {
+		if _, err := gitResolveCommit(ctx, s.repoPath, s.defaultRef); err == nil {
+			return s.defaultRef, nil
+		}
+	}
+	headRef, _, err := gitHead(ctx, s.repoPath)
+	return headRef, err
+}
+
+// loadTemplates parses the embedded page templates, keyed by page name.
+func loadTemplates() (map[string]*template.Template, error) {
 	// Parse layout first and then create a per-page template by cloning
 	funcMap := template.FuncMap{"parentPath": parentPath}
 	base := template.Must(template.New("layout").Funcs(funcMap).ParseFS(templatesFS, "templates/layout.html"))
@@ -172,85 +610,151 @@ func newServer(repoPath string) (*Server, error) {
 		}
 		tpls[page] = clone
 	}
-
-	return &Server{
-		repoPath: top,
-		repoName: repoName,
-		tmpls:    tpls,
-	}, nil
+	return tpls, nil
 }
 
 // routes builds the HTTP handler tree for the server.
 func (s *Server) routes() http.Handler {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", s.handleIndex)
-	mux.HandleFunc("/tree", s.handleTree)
-	mux.HandleFunc("/blob", s.handleBlob)
-	mux.HandleFunc("/raw", s.handleRaw)
-	mux.HandleFunc("/commits", s.handleCommits)
-	mux.HandleFunc("/diff", s.handleDiff)
-	mux.HandleFunc("/pages/", s.handlePages)
-	mux.HandleFunc("/workflows", s.handleWorkflows)
-	mux.HandleFunc("/static/app.css", handleAppCSS)
-	mux.HandleFunc("/static/app.js", handleAppJS)
+	t := s.cfg.Timeouts
+	// Metrics label requests by route, the same for every repository.
+	routePrefix := ""
+	if s.multiRepo {
+		routePrefix = "/{repo}"
+	}
+	handle := func(pattern string, d time.Duration, h http.HandlerFunc) {
+		mux.Handle(pattern, withRoute(routePrefix+pattern, withTimeout(d, h)))
+	}
+	handle("/", t.Git, s.handleIndex)
+	handle("/tree", t.Git, s.handleTree)
+	handle("/blob", t.Git, s.handleBlob)
+	handle("/raw", t.Git, s.handleRaw)
+	handle("/commits", t.Git, s.handleCommits)
+	handle("/diff", t.Diff, s.handleDiff)
+	if s.cfg.Features.Pages {
+		handle("/pages-compare", t.Diff, s.handlePagesCompare)
+		if s.cfg.Pages.separate() {
+			handle("/pages/", t.Git, s.redirectToPages)
+		} else {
+			handle("/pages/", t.Git, s.handlePages)
+		}
+	}
+	if s.cfg.Features.Workflows {
+		handle("/workflows", t.Git, s.handleWorkflows)
+	}
+	handle("/archive", t.Archive, s.handleArchive)
 	return mux
 }
 
 // handleIndex renders the overview page for the repository.
 func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
-	headRef, headHash, err := gitHead(s.repoPath)
+	ctx := r.Context()
+	if r.URL.Path != "/" {
+		s.httpError(w, r, http.StatusNotFound, "Page not found", nil)
+		return
+	}
+	_, headHash, err := gitHead(ctx, s.repoPath)
+	if err != nil {
+		s.httpError(w, r, http.StatusInternalServerError, "Failed to read HEAD", err)
+		return
+	}
+	def, err := s.resolveDefaultRef(ctx)
+	if err != nil {
+		s.httpError(w, r, http.StatusInternalServerError, "Failed to read HEAD", err)
+		return
+	}
+	ref, err := s.resolveRef(ctx, def)
 	if err != nil {
 		s.httpError(w, r, http.StatusInternalServerError, "Failed to read HEAD", err)
 		return
 	}
 
-	base, err := s.baseData(headRef)
+	base, err := s.baseData(r, ref)
 	if err != nil {
 		s.httpError(w, r, http.StatusInternalServerError, "Failed to load repo metadata", err)
 		return
 	}
+	// Fall back to a visible branch if the default ref is hidden.
+	if !s.allowed(r, ref.Name, aclPath{path: aclAny}) {
+		base.Ref, base.Commit, headHash = "", "", ""
+		if len(base.Branches) > 0 {
+			base.Ref = base.Branches[0]
+		}
+	}
 
 	data := IndexData{
-		BaseData: base,
-		HeadHash: headHash,
+		BaseData:    base,
+		HeadHash:    headHash,
+		Bare:        s.bare,
+		Description: s.repoDescription(ctx),
+	}
+	if s.cfg.Features.Clone {
+		data.CloneURL = requestScheme(r) + "://" + r.Host + s.cloneURLPath()
 	}
 
 	t, ok := s.tmpls["index"]
 	if !ok {
-		log.Printf("template not found: index")
+		slog.ErrorContext(r.Context(), "template not found", "template", "index")
 		http.Error(w, "template not found", http.StatusInternalServerError)
 		return
 	}
 	if err := t.ExecuteTemplate(w, "index", data); err != nil {
-		log.Printf("render index: %v", err)
+		slog.ErrorContext(r.Context(), "render template", "template", "index", "err", err)
 	}
 }
 
 // handleTree renders a directory listing for a given ref and path.
 func (s *Server) handleTree(w http.ResponseWriter, r *http.Request) {
-	ref := r.URL.Query().Get("ref")
-	path := normalizeRepoPath(r.URL.Query().Get("path"))
-
-	if ref == "" {
-		headRef, _, err := gitHead(s.repoPath)
-		if err != nil {
-			s.httpError(w, r, http.StatusInternalServerError, "Failed to read HEAD", err)
-			return
-		}
-		ref = headRef
+	ctx := r.Context()
+	ref, err := s.queryRef(r, "ref")
+	if err != nil {
+		s.resolveError(w, r, err)
+		return
+	}
+	path, err := cleanPath(r.URL.Query().Get("path"))
+	if err != nil {
+		s.resolveError(w, r, err)
+		return
 	}
 
-	base, err := s.baseData(ref)
+	base, err := s.baseData(r, ref)
 	if err != nil {
 		s.httpError(w, r, http.StatusInternalServerError, "Failed to load repo metadata", err)
 		return
 	}
 
-	entries, err := gitLsTree(s.repoPath, ref, path)
+	if !s.allowed(r, ref.Name, aclPath{path: path, dir: true}) {
+		s.httpError(w, r, http.StatusNotFound, "Path not found", nil)
+		return
+	}
+
+	loc, err := locate(ctx, s.repoPath, ref.Commit, path)
 	if err != nil {
 		s.httpError(w, r, http.StatusInternalServerError, "Failed to read tree", err)
 		return
 	}
+	switch {
+	case !loc.Found:
+		s.httpError(w, r, http.StatusNotFound, "Path not found", nil)
+		return
+	case loc.Entry.IsSubmodule():
+		s.httpError(w, r, http.StatusNotFound, submoduleMessage(loc.Entry), nil)
+		return
+	case loc.Entry.Type == "blob":
+		http.Redirect(w, r, s.basePath+"/blob?"+refPathQuery(ref.Name, path), http.StatusFound)
+		return
+	}
+
+	entries, err := gitLsTree(ctx, loc.RepoPath, loc.Ref, loc.Path)
+	if err != nil {
+		s.httpError(w, r, http.StatusInternalServerError, "Failed to read tree", err)
+		return
+	}
+	entries = s.filterEntries(r, ref.Name, path, entries)
+	if err := annotateEntries(ctx, loc.RepoPath, loc.Ref, loc.Path, entries); err != nil {
+		s.httpError(w, r, http.StatusInternalServerError, "Failed to read tree", err)
+		return
+	}
 
 	parent := parentPath(path)
 
@@ -263,105 +767,229 @@ func (s *Server) handleTree(w http.ResponseWriter, r *http.Request) {
 
 	t, ok := s.tmpls["tree"]
 	if !ok {
-		log.Printf("template not found: tree")
+		slog.ErrorContext(r.Context(), "template not found", "template", "tree")
 		http.Error(w, "template not found", http.StatusInternalServerError)
 		return
 	}
 	if err := t.ExecuteTemplate(w, "tree", data); err != nil {
-		log.Printf("render tree: %v", err)
+		slog.ErrorContext(r.Context(), "render template", "template", "tree", "err", err)
 	}
 }
 
 // handleBlob renders a file content page for a given ref and path.
 func (s *Server) handleBlob(w http.ResponseWriter, r *http.Request) {
-	ref := r.URL.Query().Get("ref")
-	path := normalizeRepoPath(r.URL.Query().Get("path"))
-	if ref == "" || path == "" {
+	ctx := r.Context()
+	if r.URL.Query().Get("ref") == "" || r.URL.Query().Get("path") == "" {
 		s.httpError(w, r, http.StatusBadRequest, "ref and path are required", nil)
 		return
 	}
+	ref, err := s.queryRef(r, "ref")
+	if err != nil {
+		s.resolveError(w, r, err)
+		return
+	}
+	path, err := cleanPath(r.URL.Query().Get("path"))
+	if err != nil {
+		s.resolveError(w, r, err)
+		return
+	}
 
-	base, err := s.baseData(ref)
+	base, err := s.baseData(r, ref)
 	if err != nil {
 		s.httpError(w, r, http.StatusInternalServerError, "Failed to load repo metadata", err)
 		return
 	}
 
-	spec := fmt.Sprintf("%s:%s", ref, path)
-	content, err := gitShowFile(s.repoPath, spec)
+	if !s.allowed(r, ref.Name, aclPath{path: path}) {
+		s.httpError(w, r, http.StatusNotFound, "File not found", nil)
+		return
+	}
+
+	loc, err := locate(ctx, s.repoPath, ref.Commit, path)
+	if err != nil {
+		s.httpError(w, r, http.StatusInternalServerError, "Failed to read file", err)
+		return
+	}
+	switch {
+	case !loc.Found:
+		s.httpError(w, r, http.StatusNotFound, "File not found", nil)
+		return
+	case loc.Entry.IsSubmodule():
+		s.httpError(w, r, http.StatusNotFound, submoduleMessage(loc.Entry), nil)
+		return
+	case loc.Entry.Type != "blob":
+		http.Redirect(w, r, s.basePath+"/tree?"+refPathQuery(ref.Name, path), http.StatusFound)
+		return
+	}
+
+	if loc.Entry.IsSymlink() {
+		target, err := runGit(ctx, loc.RepoPath, "cat-file", "blob", loc.Entry.Object)
+		if err != nil {
+			s.httpError(w, r, http.StatusInternalServerError, "Failed to read symlink", err)
+			return
+		}
+		data := BlobData{
+			BaseData:   base,
+			Path:       path,
+			Symlink:    true,
+			Target:     target,
+			TargetPath: resolveSymlink(parentPath(path), target),
+		}
+		s.renderBlob(w, r, data)
+		return
+	}
+
+	spec := fmt.Sprintf("%s:%s", loc.Ref, loc.Path)
+	content, err := gitShowFile(ctx, loc.RepoPath, spec)
 	if err != nil {
 		s.httpError(w, r, http.StatusInternalServerError, "Failed to read file", err)
 		return
 	}
 
-	const maxPreview = 200 * 1024 // 200 KiB
-	truncated := len(content) > maxPreview
+	truncated := int64(len(content)) > s.cfg.MaxPreview
 	if truncated {
-		content = content[:maxPreview]
+		content = content[:s.cfg.MaxPreview]
 	}
 
 	data := BlobData{
-		BaseData:  base,
-		Path:      path,
-		Content:   string(content),
-		Truncated: truncated,
+		BaseData:   base,
+		Path:       path,
+		Content:    string(content),
+		Truncated:  truncated,
+		Executable: loc.Entry.IsExecutable(),
 	}
+	s.renderBlob(w, r, data)
+}
 
+// renderBlob executes the blob template with the given data.
+func (s *Server) renderBlob(w http.ResponseWriter, r *http.Request, data BlobData) {
 	t, ok := s.tmpls["blob"]
 	if !ok {
-		log.Printf("template not found: blob")
+		slog.ErrorContext(r.Context(), "template not found", "template", "blob")
 		http.Error(w, "template not found", http.StatusInternalServerError)
 		return
 	}
 	if err := t.ExecuteTemplate(w, "blob", data); err != nil {
-		log.Printf("render blob: %v", err)
+		slog.ErrorContext(r.Context(), "render template", "template", "blob", "err", err)
 	}
 }
 
 // handleRaw streams raw file bytes for a given ref and path.
 func (s *Server) handleRaw(w http.ResponseWriter, r *http.Request) {
-	ref := r.URL.Query().Get("ref")
-	path := normalizeRepoPath(r.URL.Query().Get("path"))
-	if ref == "" || path == "" {
+	ctx := r.Context()
+	if r.URL.Query().Get("ref") == "" || r.URL.Query().Get("path") == "" {
 		s.httpError(w, r, http.StatusBadRequest, "ref and path are required", nil)
 		return
 	}
+	ref, err := s.queryRef(r, "ref")
+	if err != nil {
+		s.resolveError(w, r, err)
+		return
+	}
+	path, err := cleanPath(r.URL.Query().Get("path"))
+	if err != nil {
+		s.resolveError(w, r, err)
+		return
+	}
 
-	spec := fmt.Sprintf("%s:%s", ref, path)
-	content, err := gitShowFile(s.repoPath, spec)
+	if !s.allowed(r, ref.Name, aclPath{path: path}) {
+		s.httpError(w, r, http.StatusNotFound, "File not found", nil)
+		return
+	}
+
+	loc, err := locate(ctx, s.repoPath, ref.Commit, path)
 	if err != nil {
 		s.httpError(w, r, http.StatusInternalServerError, "Failed to read file", err)
 		return
 	}
+	if !loc.Found || loc.Entry.Type != "blob" {
+		s.httpError(w, r, http.StatusNotFound, "File not found", nil)
+		return
+	}
 
 	ext := filepath.Ext(path)
 	contentType := mime.TypeByExtension(ext)
 	if contentType == "" {
 		contentType = "application/octet-stream"
 	}
-	w.Header().Set("Content-Type", contentType)
-	_, _ = w.Write(content)
-}
+	// Raw files are untrusted: scripts never run on the viewer's origin.
+	h := w.Header()
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Security-Policy", rawCSP)
+	if isScriptable(contentType) {
+		h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": pathpkg.Base(path)}))
+	}
 
-// handleCommits renders a short commit log for the given ref.
-func (s *Server) handleCommits(w http.ResponseWriter, r *http.Request) {
-	ref := r.URL.Query().Get("ref")
-	if ref == "" {
-		headRef, _, err := gitHead(s.repoPath)
+	// Prefer a committed precompressed copy, as static hosts do.
+	if compressible(contentType) {
+		varyEncoding(h)
+	}
+	if compressible(contentType) && chooseEncoding(r, []string{"br", "gzip"}) != "" {
+		var specs []string
+		for _, pc := range precompressedFiles {
+			specs = append(specs, loc.Path+pc.ext)
+		}
+		out, err := runGitRaw(ctx, loc.RepoPath, append([]string{"ls-tree", "-z", "-l", "--end-of-options", loc.Ref, "--"}, specs...)...)
 		if err != nil {
-			s.httpError(w, r, http.StatusInternalServerError, "Failed to read HEAD", err)
+			s.httpError(w, r, http.StatusInternalServerError, "Failed to read file", err)
 			return
 		}
-		ref = headRef
+		blobs := make(map[string]string)
+		for _, e := range parseLsTree(out) {
+			if e.Type == "blob" {
+				blobs[e.Name] = e.Object
+			}
+		}
+		copies := make(map[string]string)
+		var codings []string
+		for _, pc := range precompressedFiles {
+			if obj, ok := blobs[loc.Path+pc.ext]; ok && s.allowed(r, ref.Name, aclPath{path: path + pc.ext}) {
+				copies[pc.coding] = obj
+				codings = append(codings, pc.coding)
+			}
+		}
+		if coding := chooseEncoding(r, codings); coding != "" {
+			content, err := gitShowFile(ctx, loc.RepoPath, copies[coding])
+			if err != nil {
+				s.httpError(w, r, http.StatusInternalServerError, "Failed to read file", err)
+				return
+			}
+			writePrecompressed(w, http.StatusOK, coding, content)
+			return
+		}
+	}
+
+	spec := fmt.Sprintf("%s:%s", loc.Ref, loc.Path)
+	content, err := gitShowFile(ctx, loc.RepoPath, spec)
+	if err != nil {
+		s.httpError(w, r, http.StatusInternalServerError, "Failed to read file", err)
+		return
+	}
+	writeContent(w, r, http.StatusOK, content)
+}
+
+// handleCommits renders a short commit log for the given ref.
+func (s *Server) handleCommits(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ref, err := s.queryRef(r, "ref")
+	if err != nil {
+		s.resolveError(w, r, err)
+		return
+	}
+
+	// Commits may touch any path, so all of the ref must be visible.
+	if !s.allowed(r, ref.Name, aclPath{path: aclAll}) {
+		s.httpError(w, r, http.StatusNotFound, "Unknown ref", nil)
+		return
 	}
 
-	base, err := s.baseData(ref)
+	base, err := s.baseData(r, ref)
 	if err != nil {
 		s.httpError(w, r, http.StatusInternalServerError, "Failed to load repo metadata", err)
 		return
 	}
 
-	commits, err := gitLog(s.repoPath, ref, 50)
+	commits, err := gitLog(ctx, s.repoPath, ref.Commit, s.cfg.CommitsPerPage)
 	if err != nil {
 		s.httpError(w, r, http.StatusInternalServerError, "Failed to read commits", err)
 		return
@@ -374,32 +1002,47 @@ func (s *Server) handleCommits(w http.ResponseWriter, r *http.Request) {
 
 	t, ok := s.tmpls["commits"]
 	if !ok {
-		log.Printf("template not found: commits")
+		slog.ErrorContext(r.Context(), "template not found", "template", "commits")
 		http.Error(w, "template not found", http.StatusInternalServerError)
 		return
 	}
 	if err := t.ExecuteTemplate(w, "commits", data); err != nil {
-		log.Printf("render commits: %v", err)
+		slog.ErrorContext(r.Context(), "render template", "template", "commits", "err", err)
 	}
 }
 
 // handleDiff renders a diff between two commits or refs.
 func (s *Server) handleDiff(w http.ResponseWriter, r *http.Request) {
-	from := r.URL.Query().Get("from")
-	to := r.URL.Query().Get("to")
-	if from == "" || to == "" {
+	ctx := r.Context()
+	if r.URL.Query().Get("from") == "" || r.URL.Query().Get("to") == "" {
 		s.httpError(w, r, http.StatusBadRequest, "from and to query parameters are required", nil)
 		return
 	}
+	from, err := s.queryRef(r, "from")
+	if err != nil {
+		s.resolveError(w, r, err)
+		return
+	}
+	to, err := s.queryRef(r, "to")
+	if err != nil {
+		s.resolveError(w, r, err)
+		return
+	}
 
 	// Use "to" as the current ref for nav.
-	base, err := s.baseData(to)
+	base, err := s.baseData(r, to)
 	if err != nil {
 		s.httpError(w, r, http.StatusInternalServerError, "Failed to load repo metadata", err)
 		return
 	}
 
-	patch, err := gitDiff(s.repoPath, from, to)
+	// A diff may touch any path, so both sides must be fully visible.
+	if !s.allowed(r, from.Name, aclPath{path: aclAll}) || !s.allowed(r, to.Name, aclPath{path: aclAll}) {
+		s.httpError(w, r, http.StatusNotFound, "Unknown ref", nil)
+		return
+	}
+
+	patch, err := gitDiff(ctx, s.repoPath, from.Commit, to.Commit)
 	if err != nil {
 		s.httpError(w, r, http.StatusInternalServerError, "Failed to compute diff", err)
 		return
@@ -407,196 +1050,227 @@ func (s *Server) handleDiff(w http.ResponseWriter, r *http.Request) {
 
 	data := DiffData{
 		BaseData: base,
-		From:     from,
-		To:       to,
+		From:     from.Name,
+		To:       to.Name,
 		Patch:    patch,
 	}
 
 	t, ok := s.tmpls["diff"]
 	if !ok {
-		log.Printf("template not found: diff")
+		slog.ErrorContext(r.Context(), "template not found", "template", "diff")
 		http.Error(w, "template not found", http.StatusInternalServerError)
 		return
 	}
 	if err := t.ExecuteTemplate(w, "diff", data); err != nil {
-		log.Printf("render diff: %v", err)
+		slog.ErrorContext(r.Context(), "render template", "template", "diff", "err", err)
 	}
 }
 
-// handlePages serves the contents of any branch as a static site.
-//
-// It maps /pages/{branch}/{path} to {branch}:{path}.
-// Branch names can contain slashes. The function tries progressively longer
-// prefixes as potential branch names until it finds a match.
-// For backward compatibility, /pages/ without a branch defaults to gh-pages.
-func (s *Server) handlePages(w http.ResponseWriter, r *http.Request) {
-	// Extract path after /pages/
-	pathAfterPages := strings.TrimPrefix(r.URL.Path, "/pages/")
-	
-	// Default to gh-pages for backward compatibility
-	if pathAfterPages == "" {
-		pathAfterPages = "gh-pages/"
-	}
-	
-	// Split the path into segments
-	segments := strings.Split(strings.TrimSuffix(pathAfterPages, "/"), "/")
-	
-	// Try progressively longer prefixes as potential branch names
-	// Start from the longest possible branch name (most segments)
-	var branch string
-	var subPath string
-	found := false
-	
-	for i := len(segments); i > 0; i-- {
-		potentialBranch := strings.Join(segments[:i], "/")
-		has, err := gitHasBranch(s.repoPath, potentialBranch)
-		if err != nil {
-			s.httpError(w, r, http.StatusInternalServerError, "Failed to check branch", err)
-			return
-		}
-		if has {
-			branch = potentialBranch
-			if i < len(segments) {
-				subPath = strings.Join(segments[i:], "/")
-			}
-			// Add trailing content if URL ended with slash
-			if strings.HasSuffix(pathAfterPages, "/") && subPath != "" {
-				subPath = subPath + "/"
-			}
-			found = true
-			break
-		}
-	}
-	
-	// If no valid branch found, default to gh-pages
-	if !found {
-		branch = "gh-pages"
-		subPath = pathAfterPages
-		// Verify gh-pages exists
-		has, err := gitHasBranch(s.repoPath, "gh-pages")
-		if err != nil {
-			s.httpError(w, r, http.StatusInternalServerError, "Failed to check gh-pages branch", err)
-			return
-		}
-		if !has {
-			s.httpError(w, r, http.StatusNotFound, "No valid branch found in path and gh-pages branch does not exist", nil)
-			return
-		}
-	}
-
-	subPath = normalizeRepoPath(subPath)
-
-	if subPath == "" || strings.HasSuffix(subPath, "/") {
-		subPath = subPath + "index.html"
-	}
-
-	spec := fmt.Sprintf("%s:%s", branch, subPath)
-	content, err := gitShowFile(s.repoPath, spec)
-	if err != nil {
-		s.httpError(w, r, http.StatusNotFound, fmt.Sprintf("File not found in %s", branch), err)
-		return
-	}
-
-	ext := filepath.Ext(subPath)
-	contentType := mime.TypeByExtension(ext)
-	if contentType == "" {
-		contentType = "application/octet-stream"
-	}
-	w.Header().Set("Content-Type", contentType)
-	_, _ = w.Write(content)
-}
-
 // handleWorkflows renders a list of GitHub Actions workflows (.github/workflows).
 func (s *Server) handleWorkflows(w http.ResponseWriter, r *http.Request) {
-	ref := r.URL.Query().Get("ref")
-	if ref == "" {
-		headRef, _, err := gitHead(s.repoPath)
-		if err != nil {
-			s.httpError(w, r, http.StatusInternalServerError, "Failed to read HEAD", err)
-			return
-		}
-		ref = headRef
+	ctx := r.Context()
+	ref, err := s.queryRef(r, "ref")
+	if err != nil {
+		s.resolveError(w, r, err)
+		return
 	}
 
-	base, err := s.baseData(ref)
+	base, err := s.baseData(r, ref)
 	if err != nil {
 		s.httpError(w, r, http.StatusInternalServerError, "Failed to load repo metadata", err)
 		return
 	}
 
-	paths, err := gitLsWorkflows(s.repoPath, ref)
+	paths, err := gitLsWorkflows(ctx, s.repoPath, ref.Commit)
 	if err != nil {
 		s.httpError(w, r, http.StatusInternalServerError, "Failed to list workflows", err)
 		return
 	}
+	if s.acl != nil {
+		name := s.aclRef(ctx, ref.Name)
+		visible := paths[:0]
+		for _, p := range paths {
+			if s.checkACL(r, name, aclPath{path: p}) {
+				visible = append(visible, p)
+			}
+		}
+		paths = visible
+	}
 
 	data := WorkflowsData{
 		BaseData:  base,
-		Ref:       ref,
+		Ref:       ref.Name,
 		Workflows: paths,
 	}
 
 	t, ok := s.tmpls["workflows"]
 	if !ok {
-		log.Printf("template not found: workflows")
+		slog.ErrorContext(r.Context(), "template not found", "template", "workflows")
 		http.Error(w, "template not found", http.StatusInternalServerError)
 		return
 	}
 	if err := t.ExecuteTemplate(w, "workflows", data); err != nil {
-		log.Printf("render workflows: %v", err)
+		slog.ErrorContext(r.Context(), "render template", "template", "workflows", "err", err)
 	}
 }
 
-// baseData builds BaseData for a given ref.
-func (s *Server) baseData(ref string) (BaseData, error) {
-	branches, err := gitBranches(s.repoPath)
+// archiveFormats maps the supported archive formats to their content types.
+var archiveFormats = map[string]string{
+	"tar.gz": "application/gzip",
+	"zip":    "application/zip",
+}
+
+// handleArchive streams a tar.gz or zip snapshot of a ref, optionally limited
+// to a subdirectory. Paths marked export-ignore in .gitattributes are omitted.
+func (s *Server) handleArchive(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = "tar.gz"
+	}
+	contentType, ok := archiveFormats[format]
+	if !ok {
+		s.httpError(w, r, http.StatusBadRequest, "format must be tar.gz or zip", nil)
+		return
+	}
+	ref, err := s.queryRef(r, "ref")
 	if err != nil {
-		return BaseData{}, err
+		s.resolveError(w, r, err)
+		return
 	}
-	hasPages, err := gitHasBranch(s.repoPath, "gh-pages")
+	path, err := cleanPath(q.Get("path"))
+	if err != nil {
+		s.resolveError(w, r, err)
+		return
+	}
+
+	// Archives include everything below path, so all of it must be visible.
+	if !s.allowed(r, ref.Name, aclPath{path: aclAll}) {
+		s.httpError(w, r, http.StatusNotFound, "Unknown ref", nil)
+		return
+	}
+	commit := ref.Commit
+	if path != "" {
+		loc, err := locate(ctx, s.repoPath, commit, path)
+		if err != nil {
+			s.httpError(w, r, http.StatusInternalServerError, "Failed to read tree", err)
+			return
+		}
+		if !loc.Found || loc.RepoPath != s.repoPath {
+			s.httpError(w, r, http.StatusNotFound, "Path not found", nil)
+			return
+		}
+	}
+
+	name := s.repoName + "-" + commit[:7]
+	if path != "" {
+		name += "-" + strings.ReplaceAll(path, "/", "-")
+	}
+	args := []string{"archive", "--format=" + format, "--prefix=" + name + "/", "--end-of-options", commit}
+	if path != "" {
+		args = append(args, "--", path)
+	}
+
+	release, err := acquireGit(ctx, args)
+	if err != nil {
+		s.httpError(w, r, http.StatusServiceUnavailable, "Server busy", err)
+		return
+	}
+	defer release()
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + "." + format}))
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = s.repoPath
+	cmd.Stdout = w
+	if err := cmd.Run(); err != nil {
+		// Headers are already sent; all we can do is log.
+		slog.ErrorContext(ctx, "git archive failed", "args", args, "err", err)
+	}
+}
+
+// baseData builds BaseData for a given ref.
+func (s *Server) baseData(r *http.Request, ref resolvedRef) (BaseData, error) {
+	ctx := r.Context()
+	branches, err := gitBranches(ctx, s.repoPath)
 	if err != nil {
 		return BaseData{}, err
 	}
+	branches = s.visibleBranches(r, branches)
 
-	return BaseData{
-		RepoName:      s.repoName,
-		Ref:           ref,
+	data := BaseData{
+		Root:          s.cfg.BasePath,
+		Base:          s.basePath,
+		MultiRepo:     s.multiRepo,
+		RepoName:      s.title(),
+		Ref:           ref.Name,
+		Commit:        ref.Commit,
 		Branches:      branches,
-		HasGHPages:    hasPages,
-		PagesBranches: branches, // All branches can be viewed as pages
-	}, nil
+		ShowWorkflows: s.cfg.Features.Workflows,
+		User:          userFromContext(r.Context()),
+	}
+	if s.cfg.Features.Pages {
+		hasPages, err := gitHasBranch(ctx, s.repoPath, "gh-pages")
+		if err != nil {
+			return BaseData{}, err
+		}
+		data.HasGHPages = hasPages && s.allowed(r, "gh-pages", aclPath{path: aclAny})
+		data.PagesBranches = branches // All branches can be viewed as pages
+		data.PagesOrigin = s.pagesOrigin(r)
+		data.pagesVhost = s.pagesVhost(r)
+	}
+	return data, nil
 }
 
-// httpError logs and sends an HTTP error response.
+// httpError logs and sends an HTTP error response, with suggestions for
+// what to look at instead if the page was not found.
 func (s *Server) httpError(w http.ResponseWriter, r *http.Request, status int, msg string, err error) {
+	switch {
+	case errors.Is(err, context.Canceled):
+		// The client went away; there is nobody to answer.
+		return
+	case errors.Is(err, context.DeadlineExceeded):
+		status, msg = http.StatusGatewayTimeout, "The request took too long"
+	case errors.Is(err, errOverloaded):
+		status, msg = http.StatusServiceUnavailable, "The server is busy, please try again later"
+		w.Header().Set("Retry-After", gitSlots.retryAfter())
+	}
 	if err != nil {
-		log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+		slog.ErrorContext(r.Context(), msg, "method", r.Method, "path", r.URL.Path, "status", status, "err", err)
 	}
-	http.Error(w, msg, status)
+	data := ErrorData{
+		BaseData:  s.errorBase(r, status),
+		Status:    status,
+		Title:     http.StatusText(status),
+		Message:   msg,
+		RequestID: requestID(r.Context()),
+	}
+	if status == http.StatusNotFound {
+		data.Suggestions = s.suggestions(r)
+	}
+	writeError(w, r, s.tmpls, data)
 }
 
-// loggingMiddleware logs basic request information.
-func loggingMiddleware(next http.Handler) http.Handler {
+// writeGrace is extra time given to write a response after its operation
+// timeout, so that a timeout error can still be sent.
+const writeGrace = 5 * time.Second
+
+// withTimeout cancels git commands started by next after d and gives the
+// response as long to be written, overriding the server's write timeout.
+// A zero d means no limit.
+func withTimeout(d time.Duration, next http.Handler) http.Handler {
+	if d <= 0 {
+		return next
+	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		lw := &loggingResponseWriter{ResponseWriter: w, status: http.StatusOK}
-		next.ServeHTTP(lw, r)
-		log.Printf("%s %s %d %s", r.Method, r.URL.Path, lw.status, time.Since(start))
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		// Not all ResponseWriters support deadlines; the context still applies.
+		_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(d + writeGrace))
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
-// loggingResponseWriter wraps http.ResponseWriter to capture status codes.
-type loggingResponseWriter struct {
-	http.ResponseWriter
-	status int
-}
-
-// WriteHeader captures the status code before writing headers.
-func (w *loggingResponseWriter) WriteHeader(code int) {
-	w.status = code
-	w.ResponseWriter.WriteHeader(code)
-}
-
 // normalizeRepoPath converts backslashes to forward slashes and trims leading slashes.
 func normalizeRepoPath(p string) string {
 	p = strings.ReplaceAll(p, "\\", "/")
@@ -616,38 +1290,68 @@ func parentPath(p string) string {
 	return strings.Join(parts[:len(parts)-1], "/")
 }
 
+// refPathQuery encodes ref and path as a query string for tree/blob links.
+func refPathQuery(ref, path string) string {
+	return url.Values{"ref": {ref}, "path": {path}}.Encode()
+}
+
+// submoduleMessage describes a submodule that cannot be browsed in place.
+func submoduleMessage(e TreeEntry) string {
+	return fmt.Sprintf("Submodule %s is pinned at %s but not checked out locally", e.Name, e.ShortObject())
+}
+
 // runGit executes a git command in the given repository and returns stdout as a string.
-func runGit(repoPath string, args ...string) (string, error) {
-	cmd := exec.Command("git", args...)
+func runGit(ctx context.Context, repoPath string, args ...string) (string, error) {
+	release, err := acquireGit(ctx, args)
+	if err != nil {
+		return "", fmt.Errorf("git %v: %w", args, err)
+	}
+	defer release()
+	cmd := exec.CommandContext(ctx, "git", args...)
 	cmd.Dir = repoPath
 	out, err := cmd.Output()
 	if err != nil {
-		return "", fmt.Errorf("git %v: %w", args, err)
+		return "", gitError(ctx, args, err)
 	}
 	return string(out), nil
 }
 
 // runGitRaw executes a git command and returns stdout as bytes.
-func runGitRaw(repoPath string, args ...string) ([]byte, error) {
-	cmd := exec.Command("git", args...)
+func runGitRaw(ctx context.Context, repoPath string, args ...string) ([]byte, error) {
+	release, err := acquireGit(ctx, args)
+	if err != nil {
+		return nil, fmt.Errorf("git %v: %w", args, err)
+	}
+	defer release()
+	cmd := exec.CommandContext(ctx, "git", args...)
 	cmd.Dir = repoPath
 	out, err := cmd.Output()
 	if err != nil {
-		return nil, fmt.Errorf("git %v: %w", args, err)
+		return nil, gitError(ctx, args, err)
 	}
 	return out, nil
 }
 
+// gitError wraps the error of a failed git command. If the command was
+// killed because ctx ended, the context's error is reported instead so
+// callers can tell timeouts and disconnects from git failures.
+func gitError(ctx context.Context, args []string, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		err = ctxErr
+	}
+	return fmt.Errorf("git %v: %w", args, err)
+}
+
 // gitHead returns the current HEAD ref name (branch or "HEAD") and short hash.
-func gitHead(repoPath string) (string, string, error) {
-	ref, err := runGit(repoPath, "symbolic-ref", "--quiet", "--short", "HEAD")
+func gitHead(ctx context.Context, repoPath string) (string, string, error) {
+	ref, err := runGit(ctx, repoPath, "symbolic-ref", "--quiet", "--short", "HEAD")
 	if err != nil {
 		// Detached HEAD; use "HEAD" as pseudo ref.
 		ref = "HEAD"
 	} else {
 		ref = strings.TrimSpace(ref)
 	}
-	hash, err := runGit(repoPath, "rev-parse", "--short", "HEAD")
+	hash, err := runGit(ctx, repoPath, "rev-parse", "--short", "HEAD")
 	if err != nil {
 		return "", "", err
 	}
@@ -655,8 +1359,8 @@ func gitHead(repoPath string) (string, string, error) {
 }
 
 // gitBranches returns a list of local branch names.
-func gitBranches(repoPath string) ([]string, error) {
-	out, err := runGit(repoPath, "branch", "--format=%(refname:short)")
+func gitBranches(ctx context.Context, repoPath string) ([]string, error) {
+	out, err := runGit(ctx, repoPath, "branch", "--format=%(refname:short)")
 	if err != nil {
 		return nil, err
 	}
@@ -671,33 +1375,88 @@ func gitBranches(repoPath string) ([]string, error) {
 	return branches, nil
 }
 
+// gitRefNames returns the short names of all branches and tags.
+func gitRefNames(ctx context.Context, repoPath string) ([]string, error) {
+	out, err := runGit(ctx, repoPath, "for-each-ref", "--format=%(refname:short)", "refs/heads", "refs/tags")
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimSpace(line); line != "" && !slices.Contains(names, line) {
+			names = append(names, line)
+		}
+	}
+	return names, nil
+}
+
 // gitHasBranch reports whether the given branch exists.
-func gitHasBranch(repoPath, name string) (bool, error) {
-	cmd := exec.Command("git", "show-ref", "--verify", "--quiet", "refs/heads/"+name)
+func gitHasBranch(ctx context.Context, repoPath, name string) (bool, error) {
+	return gitHasRef(ctx, repoPath, "refs/heads/"+name)
+}
+
+// gitHasRef reports whether the given fully qualified ref exists.
+func gitHasRef(ctx context.Context, repoPath, ref string) (bool, error) {
+	cmd := exec.CommandContext(ctx, "git", "show-ref", "--verify", "--quiet", ref)
+	release, err := acquireGit(ctx, cmd.Args[1:])
+	if err != nil {
+		return false, fmt.Errorf("git %v: %w", cmd.Args[1:], err)
+	}
+	defer release()
 	cmd.Dir = repoPath
-	err := cmd.Run()
+	err = cmd.Run()
 	if err == nil {
 		return true, nil
 	}
 	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
 		return false, nil
 	}
-	return false, err
+	return false, gitError(ctx, cmd.Args[1:], err)
+}
+
+// gitResolveCommit resolves ref to a full commit hash. It returns
+// errUnknownRef if ref names no commit.
+func gitResolveCommit(ctx context.Context, repoPath, ref string) (string, error) {
+	out, err := runGit(ctx, repoPath, "rev-parse", "--verify", "--quiet", "--end-of-options", ref+"^{commit}")
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			return "", errUnknownRef
+		}
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
 }
 
 // gitLsTree lists entries in a given tree at ref/path.
-func gitLsTree(repoPath, ref, path string) ([]TreeEntry, error) {
-	args := []string{"ls-tree", "-z", "-l", ref}
+func gitLsTree(ctx context.Context, repoPath, ref, path string) ([]TreeEntry, error) {
+	treeish := ref
 	if path != "" {
-		args = append(args, "--", path)
+		treeish = ref + ":" + path
 	}
-	out, err := runGitRaw(repoPath, args...)
+	out, err := runGitRaw(ctx, repoPath, "ls-tree", "-z", "-l", "--end-of-options", treeish)
 	if err != nil {
 		return nil, err
 	}
+	entries := parseLsTree(out)
+
+	// Directories first, then files, simple stable-ish ordering by name.
+	var dirs, files []TreeEntry
+	for _, e := range entries {
+		if e.Type == "tree" {
+			dirs = append(dirs, e)
+		} else {
+			files = append(files, e)
+		}
+	}
+	return append(dirs, files...), nil
+}
+
+// parseLsTree parses NUL-terminated "git ls-tree -z -l" output.
+func parseLsTree(out []byte) []TreeEntry {
 	raw := string(out)
 	if raw == "" {
-		return nil, nil
+		return nil
 	}
 	records := strings.Split(raw, "\x00")
 	var entries []TreeEntry
@@ -705,7 +1464,7 @@ func gitLsTree(repoPath, ref, path string) ([]TreeEntry, error) {
 		if rec == "" {
 			continue
 		}
-		// Format: "<mode> <type> <object> <size>\t<name>\n"
+		// Format: "<mode> <type> <object> <size>\t<name>"
 		parts := strings.SplitN(rec, "\t", 2)
 		if len(parts) != 2 {
 			continue
@@ -716,8 +1475,6 @@ func gitLsTree(repoPath, ref, path string) ([]TreeEntry, error) {
 		if len(metaParts) < 4 {
 			continue
 		}
-		mode := metaParts[0]
-		typ := metaParts[1]
 		sizeStr := metaParts[3]
 		var sz int64
 		if sizeStr != "-" {
@@ -725,36 +1482,193 @@ func gitLsTree(repoPath, ref, path string) ([]TreeEntry, error) {
 				sz = v
 			}
 		}
-		entry := TreeEntry{
-			Name: name,
-			Mode: mode,
-			Type: typ,
-			Size: sz,
+		entries = append(entries, TreeEntry{
+			Name:   name,
+			Mode:   metaParts[0],
+			Type:   metaParts[1],
+			Object: metaParts[2],
+			Size:   sz,
+		})
+	}
+	return entries
+}
+
+// gitSubmodules returns a map from submodule path to URL as recorded in
+// .gitmodules at the given ref. A missing .gitmodules yields an empty map.
+func gitSubmodules(ctx context.Context, repoPath, ref string) (map[string]string, error) {
+	subs := make(map[string]string)
+	has, err := gitObjectExists(ctx, repoPath, ref+":.gitmodules")
+	if err != nil || !has {
+		return subs, err
+	}
+	out, err := runGit(ctx, repoPath, "config", "--blob", ref+":.gitmodules", "--get-regexp", `^submodule\..*\.(path|url)$`)
+	if err != nil {
+		// Exit status 1 means no matching keys.
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			return subs, nil
 		}
-		entries = append(entries, entry)
+		return nil, err
+	}
+	paths := make(map[string]string) // submodule name -> path
+	urls := make(map[string]string)  // submodule name -> url
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		key, val, ok := strings.Cut(line, " ")
+		if !ok {
+			continue
+		}
+		key = strings.TrimPrefix(key, "submodule.")
+		if name, ok := strings.CutSuffix(key, ".path"); ok {
+			paths[name] = val
+		} else if name, ok := strings.CutSuffix(key, ".url"); ok {
+			urls[name] = val
+		}
+	}
+	for name, p := range paths {
+		subs[p] = urls[name]
 	}
+	return subs, nil
+}
 
-	// Directories first, then files, simple stable-ish ordering by name.
-	var dirs, files []TreeEntry
-	for _, e := range entries {
-		if e.Type == "tree" {
-			dirs = append(dirs, e)
-		} else {
-			files = append(files, e)
+// gitObjectExists reports whether the given object or revision spec resolves.
+func gitObjectExists(ctx context.Context, repoPath, spec string) (bool, error) {
+	cmd := exec.CommandContext(ctx, "git", "cat-file", "-e", spec)
+	release, err := acquireGit(ctx, cmd.Args[1:])
+	if err != nil {
+		return false, fmt.Errorf("git %v: %w", cmd.Args[1:], err)
+	}
+	defer release()
+	cmd.Dir = repoPath
+	err = cmd.Run()
+	if err == nil {
+		return true, nil
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 128 {
+		return false, nil
+	}
+	return false, gitError(ctx, cmd.Args[1:], err)
+}
+
+// gitLocation identifies where a repository path lives, following submodule
+// boundaries into local submodule checkouts.
+type gitLocation struct {
+	RepoPath string    // repository that holds Path
+	Ref      string    // ref or commit to read from in RepoPath
+	Path     string    // path relative to RepoPath
+	Entry    TreeEntry // the entry at Path; zero value for the root tree
+	Found    bool      // whether Path exists
+}
+
+// locate resolves path at ref in the repository at repoPath. If path crosses
+// or names a submodule whose checkout exists locally, the lookup continues
+// inside the submodule at its pinned commit. A submodule without a local
+// checkout is returned as a gitlink entry.
+func locate(ctx context.Context, repoPath, ref, path string) (gitLocation, error) {
+	loc := gitLocation{RepoPath: repoPath, Ref: ref, Path: path}
+	if path == "" {
+		loc.Found = true
+		return loc, nil
+	}
+
+	// List every prefix of path at once; ls-tree reports gitlinks on the way
+	// down as well as the final entry.
+	parts := strings.Split(path, "/")
+	args := []string{"ls-tree", "-z", "-l", "--end-of-options", ref, "--"}
+	for i := range parts {
+		args = append(args, strings.Join(parts[:i+1], "/"))
+	}
+	out, err := runGitRaw(ctx, repoPath, args...)
+	if err != nil {
+		return loc, err
+	}
+	for _, e := range parseLsTree(out) {
+		if e.Name == path {
+			if e.IsSubmodule() {
+				subRepo := filepath.Join(repoPath, filepath.FromSlash(e.Name))
+				if submoduleCheckedOut(ctx, subRepo, e.Object) {
+					return gitLocation{RepoPath: subRepo, Ref: e.Object, Found: true}, nil
+				}
+			}
+			e.Name = parts[len(parts)-1]
+			loc.Entry = e
+			loc.Found = true
+			return loc, nil
+		}
+		if e.IsSubmodule() && strings.HasPrefix(path, e.Name+"/") {
+			subRepo := filepath.Join(repoPath, filepath.FromSlash(e.Name))
+			if !submoduleCheckedOut(ctx, subRepo, e.Object) {
+				return loc, nil
+			}
+			return locate(ctx, subRepo, e.Object, strings.TrimPrefix(path, e.Name+"/"))
 		}
 	}
-	return append(dirs, files...), nil
+	return loc, nil
+}
+
+// submoduleCheckedOut reports whether dir holds a local checkout of a
+// submodule that contains the given commit.
+func submoduleCheckedOut(ctx context.Context, dir, commit string) bool {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+		return false
+	}
+	has, err := gitObjectExists(ctx, dir, commit+"^{commit}")
+	return err == nil && has
+}
+
+// annotateEntries fills in symlink targets and submodule details for entries
+// listed from dir at ref.
+func annotateEntries(ctx context.Context, repoPath, ref, dir string, entries []TreeEntry) error {
+	var subs map[string]string
+	for i := range entries {
+		e := &entries[i]
+		full := e.Name
+		if dir != "" {
+			full = dir + "/" + e.Name
+		}
+		switch {
+		case e.IsSymlink():
+			target, err := runGit(ctx, repoPath, "cat-file", "blob", e.Object)
+			if err != nil {
+				return err
+			}
+			e.Target = target
+			e.TargetPath = resolveSymlink(dir, target)
+		case e.IsSubmodule():
+			if subs == nil {
+				var err error
+				if subs, err = gitSubmodules(ctx, repoPath, ref); err != nil {
+					return err
+				}
+			}
+			e.SubmoduleURL = subs[full]
+			e.SubmoduleLocal = submoduleCheckedOut(ctx, filepath.Join(repoPath, filepath.FromSlash(full)), e.Object)
+		}
+	}
+	return nil
+}
+
+// resolveSymlink resolves a symlink target relative to the directory holding
+// the link. It returns "" if the target is absolute or escapes the repository.
+func resolveSymlink(dir, target string) string {
+	if target == "" || strings.HasPrefix(target, "/") {
+		return ""
+	}
+	p := pathpkg.Join(dir, target)
+	if p == "." || p == ".." || strings.HasPrefix(p, "../") {
+		return ""
+	}
+	return p
 }
 
 // gitShowFile returns the content of ref:path from the repository.
-func gitShowFile(repoPath, spec string) ([]byte, error) {
-	return runGitRaw(repoPath, "show", spec)
+func gitShowFile(ctx context.Context, repoPath, spec string) ([]byte, error) {
+	return runGitRaw(ctx, repoPath, "show", "--end-of-options", spec)
 }
 
 // gitLog returns a short log for a given ref, limited to n commits.
-func gitLog(repoPath, ref string, n int) ([]Commit, error) {
+func gitLog(ctx context.Context, repoPath, ref string, n int) ([]Commit, error) {
 	format := "%h%x09%ad%x09%s"
-	out, err := runGit(repoPath, "log", "--date=short", fmt.Sprintf("-n%d", n), "--pretty=format:"+format, ref)
+	out, err := runGit(ctx, repoPath, "log", "--date=short", fmt.Sprintf("-n%d", n), "--pretty=format:"+format, "--end-of-options", ref)
 	if err != nil {
 		return nil, err
 	}
@@ -778,8 +1692,8 @@ func gitLog(repoPath, ref string, n int) ([]Commit, error) {
 }
 
 // gitDiff returns a unified diff between from and to.
-func gitDiff(repoPath, from, to string) (string, error) {
-	out, err := runGit(repoPath, "diff", "--stat", "--patch", from, to)
+func gitDiff(ctx context.Context, repoPath, from, to string) (string, error) {
+	out, err := runGit(ctx, repoPath, "diff", "--stat", "--patch", "--end-of-options", from, to)
 	if err != nil {
 		return "", err
 	}
@@ -790,8 +1704,8 @@ func gitDiff(repoPath, from, to string) (string, error) {
 }
 
 // gitLsWorkflows lists files under .github/workflows at the given ref.
-func gitLsWorkflows(repoPath, ref string) ([]string, error) {
-	out, err := runGit(repoPath, "ls-tree", "--name-only", "-z", ref, "--", ".github/workflows")
+func gitLsWorkflows(ctx context.Context, repoPath, ref string) ([]string, error) {
+	out, err := runGit(ctx, repoPath, "ls-tree", "--name-only", "-z", "--end-of-options", ref, "--", ".github/workflows")
 	if err != nil {
 		return nil, err
 	}
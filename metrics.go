@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// durationBuckets are the upper bounds, in seconds, of latency histograms.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// metrics collects the counters exported at /metrics.
+var metrics = newRegistry()
+
+// registry holds request and git command metrics in memory and renders
+// them in the Prometheus text exposition format.
+type registry struct {
+	inFlight atomic.Int64
+
+	mu          sync.Mutex
+	requests    map[[2]string]uint64  // {route, code} -> count
+	reqDuration map[string]*histogram // route -> latency
+	gitDuration map[string]*histogram // subcommand -> duration
+	cache       map[[2]string]uint64  // {cache, "hit" or "miss"} -> count
+	rateLimiter *rateLimiter          // nil unless rate limiting is on
+}
+
+// histogram counts observations into durationBuckets.
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// newRegistry returns an empty registry.
+func newRegistry() *registry {
+	return &registry{
+		requests:    make(map[[2]string]uint64),
+		reqDuration: make(map[string]*histogram),
+		gitDuration: make(map[string]*histogram),
+		cache:       make(map[[2]string]uint64),
+	}
+}
+
+// observe adds a duration to the histogram for key in m.
+func observe(m map[string]*histogram, key string, d time.Duration) {
+	h, ok := m[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(durationBuckets))}
+		m[key] = h
+	}
+	sec := d.Seconds()
+	if i, _ := slices.BinarySearch(durationBuckets, sec); i < len(durationBuckets) {
+		h.counts[i]++
+	}
+	h.sum += sec
+	h.count++
+}
+
+// observeRequest records a finished request.
+func (m *registry) observeRequest(route string, code int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[[2]string{route, strconv.Itoa(code)}]++
+	observe(m.reqDuration, route, d)
+}
+
+// observeGit records a finished git command.
+func (m *registry) observeGit(subcommand string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	observe(m.gitDuration, subcommand, d)
+}
+
+// observeCache records a lookup in the named in-memory cache.
+func (m *registry) observeCache(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cache[[2]string{cache, result}]++
+}
+
+// routeKey is the context key for the *string that handlers fill in with
+// their route, so that metrics are labelled by route rather than by path.
+type routeKey struct{}
+
+// withRoute labels requests handled by next with route.
+func withRoute(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setRoute(r, route)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// setRoute labels the request with route for metrics.
+func setRoute(r *http.Request, route string) {
+	if p, ok := r.Context().Value(routeKey{}).(*string); ok {
+		*p = route
+	}
+}
+
+// instrument counts requests and their latency by route and status.
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		metrics.inFlight.Add(1)
+		defer metrics.inFlight.Add(-1)
+		route := "other"
+		r = r.WithContext(context.WithValue(r.Context(), routeKey{}, &route))
+		lw := &loggingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(lw, r)
+		metrics.observeRequest(route, lw.status, time.Since(start))
+	})
+}
+
+// handleMetrics serves all metrics in the Prometheus text format.
+func handleMetrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.write(w)
+}
+
+// write renders the metrics in the Prometheus text format.
+func (m *registry) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	header(w, "gitviewer_http_requests_total", "counter", "HTTP requests by route and status code.")
+	for _, k := range sortedPairs(m.requests) {
+		fmt.Fprintf(w, "gitviewer_http_requests_total{route=%s,code=%s} %d\n", quote(k[0]), quote(k[1]), m.requests[k])
+	}
+
+	header(w, "gitviewer_http_request_duration_seconds", "histogram", "HTTP request latency by route.")
+	writeHistograms(w, "gitviewer_http_request_duration_seconds", "route", m.reqDuration)
+
+	header(w, "gitviewer_http_requests_in_flight", "gauge", "HTTP requests currently being served.")
+	fmt.Fprintf(w, "gitviewer_http_requests_in_flight %d\n", m.inFlight.Load())
+
+	header(w, "gitviewer_git_command_duration_seconds", "histogram", "Git subprocess run time by subcommand; the count is the number of commands run.")
+	writeHistograms(w, "gitviewer_git_command_duration_seconds", "subcommand", m.gitDuration)
+
+	header(w, "gitviewer_cache_requests_total", "counter", "Lookups in in-memory caches by cache and result.")
+	for _, k := range sortedPairs(m.cache) {
+		fmt.Fprintf(w, "gitviewer_cache_requests_total{cache=%s,result=%s} %d\n", quote(k[0]), quote(k[1]), m.cache[k])
+	}
+
+	if gitSlots != nil {
+		used, queued, rejected := gitSlots.stats()
+		header(w, "gitviewer_git_slots", "gauge", "Size of the git command slot pool.")
+		fmt.Fprintf(w, "gitviewer_git_slots %d\n", gitSlots.size)
+		header(w, "gitviewer_git_slots_used", "gauge", "Git command slots currently in use.")
+		fmt.Fprintf(w, "gitviewer_git_slots_used %d\n", used)
+		header(w, "gitviewer_git_queue_depth", "gauge", "Git commands waiting for slots.")
+		fmt.Fprintf(w, "gitviewer_git_queue_depth %d\n", queued)
+		header(w, "gitviewer_git_rejected_total", "counter", "Git commands refused after waiting too long for slots.")
+		fmt.Fprintf(w, "gitviewer_git_rejected_total %d\n", rejected)
+	}
+	if m.rateLimiter != nil {
+		header(w, "gitviewer_rate_limited_total", "counter", "Requests refused because the client exceeded its rate.")
+		fmt.Fprintf(w, "gitviewer_rate_limited_total %d\n", m.rateLimiter.rejected.Load())
+	}
+}
+
+// sortedPairs returns the keys of a counter with two labels in order.
+func sortedPairs(counts map[[2]string]uint64) [][2]string {
+	keys := slices.Collect(maps.Keys(counts))
+	slices.SortFunc(keys, func(a, b [2]string) int { return strings.Compare(a[0]+"\x00"+a[1], b[0]+"\x00"+b[1]) })
+	return keys
+}
+
+// header writes the HELP and TYPE lines of a metric family.
+func header(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// writeHistograms writes one histogram per label value, sorted by label.
+func writeHistograms(w io.Writer, name, label string, hs map[string]*histogram) {
+	for _, key := range slices.Sorted(maps.Keys(hs)) {
+		h := hs[key]
+		var cum uint64
+		for i, le := range durationBuckets {
+			cum += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s=%s,le=\"%s\"} %d\n", name, label, quote(key), strconv.FormatFloat(le, 'g', -1, 64), cum)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s=%s,le=\"+Inf\"} %d\n", name, label, quote(key), h.count)
+		fmt.Fprintf(w, "%s_sum{%s=%s} %g\n", name, label, quote(key), h.sum)
+		fmt.Fprintf(w, "%s_count{%s=%s} %d\n", name, label, quote(key), h.count)
+	}
+}
+
+// quote quotes a label value as required by the text format.
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCacheMetrics(t *testing.T) {
+	m := newRegistry()
+	m.observeCache("cname", false)
+	m.observeCache("cname", true)
+	m.observeCache("cname", true)
+	m.observeCache("password", false)
+	var b strings.Builder
+	m.write(&b)
+	want := `# TYPE gitviewer_cache_requests_total counter
+gitviewer_cache_requests_total{cache="cname",result="hit"} 2
+gitviewer_cache_requests_total{cache="cname",result="miss"} 1
+gitviewer_cache_requests_total{cache="password",result="miss"} 1
+`
+	if !strings.Contains(b.String(), want) {
+		t.Errorf("metrics lack\n%s\ngot\n%s", want, b.String())
+	}
+}
+
+func TestBranchCNAMEsCacheMetrics(t *testing.T) {
+	s := &Server{repoPath: newTestRepo(t), cfg: defaultConfig()}
+	count := func(result string) uint64 {
+		metrics.mu.Lock()
+		defer metrics.mu.Unlock()
+		return metrics.cache[[2]string{"cname", result}]
+	}
+	hits, misses := count("hit"), count("miss")
+	for range 3 {
+		if _, err := s.branchCNAMEs(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := count("miss") - misses; got != 1 {
+		t.Errorf("%d misses, want 1", got)
+	}
+	if got := count("hit") - hits; got != 2 {
+		t.Errorf("%d hits, want 2", got)
+	}
+}
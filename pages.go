@@ -0,0 +1,919 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	pathpkg "path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cnameCacheTTL is how long the custom domains claimed by a repository's
+// branches are reused. Every request for an unknown host name looks them
+// up, and reading them runs git over every branch.
+const cnameCacheTTL = time.Minute
+
+// cnameCache holds the result of gitBranchCNAMEs for a repository.
+type cnameCache struct {
+	mu     sync.Mutex
+	loaded time.Time
+	cnames map[string]string
+}
+
+// PagesConfig configures how branches are served as static sites. By
+// default they share the viewer's origin and run in a CSP sandbox, which
+// keeps their scripts away from the viewer but also from cookies and
+// storage. A separate listen address or host name gives them an origin of
+// their own instead.
+type PagesConfig struct {
+	Listen     string   // address that serves only pages
+	Host       string   // host name whose requests are served only pages
+	Domain     string   // {branch}.{domain} serves a branch
+	CNAMEHosts []string // host names, or *.suffixes, a branch's CNAME may claim
+	SPA        bool     // serve index.html for unknown paths
+	Autoindex  bool     // list directories without index.html, and ?sitemap
+	Rewrite    bool     // point root-relative URLs in HTML and CSS below the site's prefix
+}
+
+// separate reports whether pages have their own origin.
+func (c PagesConfig) separate() bool {
+	return c.Listen != "" || c.Host != ""
+}
+
+// Content-Security-Policy values. The viewer only loads its own script and
+// stylesheet; pages on the viewer's origin and raw files get an opaque
+// origin through the sandbox directive.
+const (
+	uiCSP           = "default-src 'none'; script-src 'self'; style-src 'self'; img-src 'self' data:; connect-src 'self'; form-action 'self'; frame-ancestors 'none'; base-uri 'none'"
+	pagesSandboxCSP = "sandbox allow-scripts allow-forms allow-popups allow-popups-to-escape-sandbox allow-modals allow-downloads"
+	rawCSP          = "default-src 'none'; img-src 'self' data:; style-src 'unsafe-inline'; sandbox"
+)
+
+// securityHeaders sets the headers that protect the viewer UI. Handlers
+// serving repository content replace them with their own.
+func securityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Content-Security-Policy", uiCSP)
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("X-Frame-Options", "DENY")
+		h.Set("Referrer-Policy", "same-origin")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// scriptableTypes are media types a browser may run scripts in. Raw files
+// of these types are downloaded rather than displayed.
+var scriptableTypes = []string{
+	"text/html",
+	"application/xhtml+xml",
+	"image/svg+xml",
+	"text/xml",
+	"application/xml",
+}
+
+// isScriptable reports whether contentType may run scripts in a browser.
+func isScriptable(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	for _, t := range scriptableTypes {
+		if mediaType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// pagesOrigin returns the scheme and host that pages are served from for
+// r, or "" if they share the viewer's origin.
+func (s *Server) pagesOrigin(r *http.Request) string {
+	c := s.cfg.Pages
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host, port = strings.Trim(r.Host, "[]"), ""
+	}
+	switch {
+	case c.Host != "":
+		if port != "" {
+			return requestScheme(r) + "://" + net.JoinHostPort(c.Host, port)
+		}
+		return requestScheme(r) + "://" + c.Host
+	case c.Listen != "":
+		_, listenPort, _ := net.SplitHostPort(c.Listen)
+		scheme := "http"
+		if s.cfg.TLS.enabled() {
+			scheme = "https"
+		}
+		return scheme + "://" + net.JoinHostPort(host, listenPort)
+	}
+	return ""
+}
+
+// pagesVhost returns the URL of branch sites for r with "*" in place of
+// the branch label, or "" without a pages domain. Branch sites are assumed
+// to be served on the port r came in on.
+func (s *Server) pagesVhost(r *http.Request) string {
+	domain := s.cfg.Pages.Domain
+	if domain == "" {
+		return ""
+	}
+	if s.multiRepo {
+		domain = strings.ToLower(s.repoName) + "." + domain
+	}
+	host := "*." + domain
+	if _, port, err := net.SplitHostPort(r.Host); err == nil {
+		host = net.JoinHostPort(host, port)
+	}
+	return requestScheme(r) + "://" + host + "/"
+}
+
+// redirectToPages sends requests for pages on the viewer's origin to the
+// pages origin.
+func (s *Server) redirectToPages(w http.ResponseWriter, r *http.Request) {
+	target := s.pagesOrigin(r) + s.basePath + r.URL.EscapedPath()
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// pagesRoutes builds the handler for the pages origin, which serves
+// nothing but the pages of every repository.
+func (h *Hub) pagesRoutes() http.Handler {
+	mux := http.NewServeMux()
+	// Error pages are styled; the script stays on the viewer's origin.
+	mux.Handle(h.root+"/static/app.css", withRoute("/static/", http.HandlerFunc(handleAppCSS)))
+	route := "/pages/"
+	if h.multi {
+		route = "/{repo}/pages/"
+	}
+	for _, srv := range h.repos {
+		if !srv.cfg.Features.Pages {
+			continue
+		}
+		pages := withRoute(route, withTimeout(srv.cfg.Timeouts.Git, http.HandlerFunc(srv.handlePages)))
+		mux.Handle(srv.basePath+"/pages/", http.StripPrefix(srv.basePath, srv.guard(pages)))
+	}
+	// Unknown repositories look like hidden ones, see guard.
+	mux.HandleFunc(h.root+"/", h.handleNotFound)
+	return mux
+}
+
+// pagesByHost serves requests for the pages host with pages, those for
+// branch host names with vhosts and all others with ui.
+func pagesByHost(c PagesConfig, pages, vhosts, ui http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := requestHostname(r)
+		switch {
+		case c.Host != "" && host == strings.ToLower(c.Host):
+			pages.ServeHTTP(w, r)
+		case c.vhost(host):
+			vhosts.ServeHTTP(w, r)
+		default:
+			ui.ServeHTTP(w, r)
+		}
+	})
+}
+
+// requestHostname returns the lower-case host name of r, without port.
+func requestHostname(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	return strings.ToLower(strings.Trim(host, "[]"))
+}
+
+// vhost reports whether host names a branch site: the pages domain, a
+// subdomain of it, or a host allowed as a branch's CNAME.
+func (c PagesConfig) vhost(host string) bool {
+	if d := strings.ToLower(c.Domain); d != "" && (host == d || strings.HasSuffix(host, "."+d)) {
+		return true
+	}
+	for _, pattern := range c.CNAMEHosts {
+		pattern = strings.ToLower(pattern)
+		if host == pattern || strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// branchLabel returns the host name label for branch: lower case, with
+// "--" for each slash and '-' for other characters not allowed in host
+// names, so that feature/New_UI becomes feature--new-ui.
+func branchLabel(branch string) string {
+	var b strings.Builder
+	for _, c := range strings.ToLower(branch) {
+		switch {
+		case c == '/':
+			b.WriteString("--")
+		case c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-':
+			b.WriteRune(c)
+		default:
+			b.WriteByte('-')
+		}
+	}
+	return b.String()
+}
+
+// vhostRoutes builds the handler for branch host names. Below the pages
+// domain, {branch}.{domain} serves a branch, or {branch}.{repo}.{domain}
+// with several repositories; the domain itself, or {repo}.{domain}, serves
+// gh-pages. Hosts allowed by CNAMEHosts serve the branch whose CNAME file
+// names them. Sites are served at the root of their host, so they need no
+// URL rewriting and each has an origin of its own.
+func (h *Hub) vhostRoutes() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setRoute(r, "vhost")
+		srv, branch, err := h.vhostBranch(r)
+		if err != nil {
+			h.repos[0].httpError(w, r, http.StatusInternalServerError, "Failed to find site", err)
+			return
+		}
+		if srv == nil {
+			writePlainError(w, r, h.tmpls, h.root, http.StatusNotFound, "No site for this host name")
+			return
+		}
+		serve := func(w http.ResponseWriter, r *http.Request) {
+			// Hidden repositories and branches have no site either.
+			if !srv.visibleRepo(r) || !srv.allowed(r, "refs/heads/"+branch, aclPath{path: aclAny}) {
+				writePlainError(w, r, h.tmpls, h.root, http.StatusNotFound, "No site for this host name")
+				return
+			}
+			pagesHeaders(w.Header(), false)
+			srv.servePages(w, r, branch, "refs/heads/"+branch, strings.TrimPrefix(r.URL.Path, "/"), "")
+		}
+		srv.guard(withTimeout(srv.cfg.Timeouts.Git, http.HandlerFunc(serve))).ServeHTTP(w, r)
+	})
+}
+
+// vhostBranch returns the repository and branch a branch host name
+// serves, or a nil Server if there is none.
+func (h *Hub) vhostBranch(r *http.Request) (*Server, string, error) {
+	ctx := r.Context()
+	host := requestHostname(r)
+	c := h.repos[0].cfg.Pages
+	domain := strings.ToLower(c.Domain)
+	if domain == "" || host != domain && !strings.HasSuffix(host, "."+domain) {
+		// A custom domain from a CNAME file.
+		for _, srv := range h.repos {
+			if !srv.cfg.Features.Pages {
+				continue
+			}
+			cnames, err := srv.branchCNAMEs(ctx)
+			if err != nil {
+				return nil, "", err
+			}
+			// Several branches may claim a domain; gh-pages wins, then
+			// the first by name.
+			if cnames["gh-pages"] == host {
+				return srv, "gh-pages", nil
+			}
+			for _, branch := range slices.Sorted(maps.Keys(cnames)) {
+				if cnames[branch] == host {
+					return srv, branch, nil
+				}
+			}
+		}
+		return nil, "", nil
+	}
+
+	var labels []string
+	if sub := strings.TrimSuffix(strings.TrimSuffix(host, domain), "."); sub != "" {
+		labels = strings.Split(sub, ".")
+	}
+	srv := h.repos[0]
+	if h.multi {
+		if len(labels) == 0 {
+			return nil, "", nil
+		}
+		srv = nil
+		for _, candidate := range h.repos {
+			if strings.EqualFold(candidate.repoName, labels[len(labels)-1]) {
+				srv = candidate
+			}
+		}
+		labels = labels[:len(labels)-1]
+	}
+	if srv == nil || !srv.cfg.Features.Pages || len(labels) > 1 {
+		return nil, "", nil
+	}
+	if len(labels) == 0 {
+		return srv, "gh-pages", nil
+	}
+	branches, err := gitBranches(ctx, srv.repoPath)
+	if err != nil {
+		return nil, "", err
+	}
+	var match string
+	for _, branch := range branches {
+		if branchLabel(branch) != labels[0] {
+			continue
+		}
+		if match != "" {
+			return nil, "", nil // ambiguous
+		}
+		match = branch
+	}
+	if match == "" {
+		return nil, "", nil
+	}
+	return srv, match, nil
+}
+
+// branchCNAMEs returns the custom domain of every branch with a CNAME
+// file, read at most cnameCacheTTL ago. Requests wait for a running
+// refresh rather than starting their own.
+func (s *Server) branchCNAMEs(ctx context.Context) (map[string]string, error) {
+	c := &s.cnames
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cnames != nil && time.Since(c.loaded) < cnameCacheTTL {
+		metrics.observeCache("cname", true)
+		return c.cnames, nil
+	}
+	metrics.observeCache("cname", false)
+	cnames, err := gitBranchCNAMEs(ctx, s.repoPath)
+	if err != nil {
+		return nil, err
+	}
+	c.cnames, c.loaded = cnames, time.Now()
+	return cnames, nil
+}
+
+// gitBranchCNAMEs returns the custom domain of every branch whose site,
+// published from the top or from docs/ as loadPagesSite decides, has a
+// CNAME file.
+func gitBranchCNAMEs(ctx context.Context, repoPath string) (map[string]string, error) {
+	branches, err := gitBranches(ctx, repoPath)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{"index.html", "docs/index.html", "CNAME", "docs/CNAME"}
+	var specs []string
+	for _, b := range branches {
+		for _, f := range files {
+			specs = append(specs, "refs/heads/"+b+":"+f)
+		}
+	}
+	out, err := gitCatFile(ctx, repoPath, "--batch-check", specs)
+	if err != nil {
+		return nil, err
+	}
+	// One line per spec: "<object> <type> <size>" or "<spec> missing".
+	lines := strings.Split(string(out), "\n")
+	var objects, owners []string
+	for i, b := range branches {
+		found := make(map[string][]string)
+		for j, f := range files {
+			if k := i*len(files) + j; k < len(lines) {
+				if fields := strings.Fields(lines[k]); len(fields) == 3 && fields[1] == "blob" {
+					found[f] = fields
+				}
+			}
+		}
+		cname := found["CNAME"]
+		if found["index.html"] == nil && found["docs/index.html"] != nil {
+			cname = found["docs/CNAME"]
+		}
+		if cname == nil {
+			continue
+		}
+		if size, _ := strconv.Atoi(cname[2]); size <= 1024 {
+			objects = append(objects, cname[0])
+			owners = append(owners, b)
+		}
+	}
+
+	cnames := make(map[string]string)
+	if len(objects) == 0 {
+		return cnames, nil
+	}
+	out, err = gitCatFile(ctx, repoPath, "--batch", objects)
+	if err != nil {
+		return nil, err
+	}
+	rd := bufio.NewReader(bytes.NewReader(out))
+	for _, b := range owners {
+		header, err := rd.ReadString('\n')
+		if err != nil {
+			break
+		}
+		fields := strings.Fields(header)
+		if len(fields) != 3 {
+			continue
+		}
+		size, _ := strconv.Atoi(fields[2])
+		data := make([]byte, size+1) // and the newline
+		if _, err := io.ReadFull(rd, data); err != nil {
+			break
+		}
+		if host := parseCNAME(string(data[:size])); host != "" {
+			cnames[b] = host
+		}
+	}
+	return cnames, nil
+}
+
+// gitCatFile runs git cat-file in a batch mode with one spec per line.
+func gitCatFile(ctx context.Context, repoPath, mode string, specs []string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", "cat-file", mode)
+	release, err := acquireGit(ctx, cmd.Args[1:])
+	if err != nil {
+		return nil, fmt.Errorf("git %v: %w", cmd.Args[1:], err)
+	}
+	defer release()
+	cmd.Dir = repoPath
+	cmd.Stdin = strings.NewReader(strings.Join(specs, "\n") + "\n")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, gitError(ctx, cmd.Args[1:], err)
+	}
+	return out, nil
+}
+
+// handlePages serves the contents of any branch as a static site.
+//
+// It maps /pages/{branch}/{path} to {branch}:{path}.
+// Branch names can contain slashes. The function tries progressively longer
+// prefixes as potential branch names until it finds a match.
+// For backward compatibility, /pages/ without a branch defaults to gh-pages.
+// Tags, commits and other refs are served from the explicit URLs described
+// at parsePagesRef. Files are looked up like GitHub Pages does, see pagesSite.
+func (s *Server) handlePages(w http.ResponseWriter, r *http.Request) {
+	pagesHeaders(w.Header(), !s.cfg.Pages.separate())
+
+	// Extract path after /pages/
+	pathAfterPages := strings.TrimPrefix(r.URL.Path, "/pages/")
+
+	// Default to gh-pages for backward compatibility
+	if pathAfterPages == "" {
+		pathAfterPages = "gh-pages/"
+	}
+
+	name, rev, subPath, explicit, err := parsePagesRef(pathAfterPages)
+	if err != nil {
+		s.resolveError(w, r, err)
+		return
+	}
+	if !explicit {
+		var found bool
+		if name, subPath, found, err = s.findPagesBranch(r, pathAfterPages); err != nil {
+			s.httpError(w, r, http.StatusInternalServerError, "Failed to check branch", err)
+			return
+		}
+		if !found {
+			s.httpError(w, r, http.StatusNotFound, "No valid branch found in path and gh-pages branch does not exist", nil)
+			return
+		}
+		rev = "refs/heads/" + name
+	}
+	s.servePages(w, r, name, rev, subPath, s.basePath)
+}
+
+// escapePath escapes p for use as the path of a URL.
+func escapePath(p string) string {
+	return (&url.URL{Path: p}).EscapedPath()
+}
+
+// pagesHeaders replaces the viewer's security headers for pages. Pages on
+// the viewer's origin are sandboxed.
+func pagesHeaders(h http.Header, sandbox bool) {
+	h.Del("X-Frame-Options")
+	h.Del("Referrer-Policy")
+	h.Set("X-Content-Type-Options", "nosniff")
+	if sandbox {
+		h.Set("Content-Security-Policy", pagesSandboxCSP)
+	} else {
+		h.Del("Content-Security-Policy")
+	}
+}
+
+// servePages serves subPath of the site at rev, which is shown as name.
+// The request's URL path ends in subPath and, below base, the rest of it
+// is the site's prefix.
+func (s *Server) servePages(w http.ResponseWriter, r *http.Request, name, rev, subPath, base string) {
+	ctx := r.Context()
+	// Nothing of a hidden ref, not even its _headers, reaches the response.
+	if !s.allowed(r, rev, aclPath{path: aclAny}) {
+		s.resolveError(w, r, errUnknownRef)
+		return
+	}
+	dir := subPath == "" || strings.HasSuffix(subPath, "/")
+	rel, err := cleanPath(subPath)
+	if err != nil {
+		s.resolveError(w, r, err)
+		return
+	}
+	ref, err := s.resolveRef(ctx, rev)
+	if err != nil {
+		s.resolveError(w, r, err)
+		return
+	}
+	site, err := s.loadPagesSite(ctx, ref.Commit, rel)
+	if err != nil {
+		s.httpError(w, r, http.StatusInternalServerError, "Failed to read site", err)
+		return
+	}
+
+	if !s.allowed(r, rev, aclPath{path: pathpkg.Join(site.root, "_redirects")}) {
+		site.redirects = nil
+	}
+	if !s.allowed(r, rev, aclPath{path: pathpkg.Join(site.root, "_headers")}) {
+		site.headers = nil
+	}
+
+	// The prefix goes into Location headers and rewritten pages, so it is
+	// kept escaped like the request's path.
+	site.prefix = base + escapePath(strings.TrimSuffix(r.URL.Path, subPath))
+	reqPath := "/" + rel
+	if dir && rel != "" {
+		reqPath += "/"
+	}
+	applyHeaders(w.Header(), site.headers, reqPath)
+
+	file, redirect := site.lookup(rel, dir)
+	// The redirect would reveal a hidden folder.
+	redirect = redirect && s.allowed(r, rev, aclPath{path: pathpkg.Join(site.root, rel), dir: true})
+	if redirect || subPath == "" && !strings.HasSuffix(r.URL.Path, "/") {
+		target := base + r.URL.EscapedPath() + "/"
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+		return
+	}
+
+	if s.cfg.Pages.Autoindex && rel == "" && r.URL.Query().Has("sitemap") {
+		s.serveSitemap(w, r, site, name, rev)
+		return
+	}
+
+	status := http.StatusOK
+	if rule, target, ok := matchRedirect(site.redirects, reqPath, file != nil); ok {
+		if rule.status >= 300 && rule.status < 400 {
+			if strings.HasPrefix(target, "/") {
+				// Site paths stay below the site's prefix.
+				target = site.prefix + strings.TrimPrefix(target, "/")
+			}
+			http.Redirect(w, r, target, rule.status)
+			return
+		}
+		file, status = nil, rule.status
+		targetPath, _, _ := strings.Cut(target, "?")
+		if to, err := cleanPath(targetPath); err == nil {
+			targetDir := strings.HasSuffix(targetPath, "/")
+			if err := s.addPagesEntries(ctx, &site, withPrecompressed(pagesCandidates(site.root, to))); err != nil {
+				s.httpError(w, r, http.StatusInternalServerError, "Failed to read site", err)
+				return
+			}
+			file, _ = site.lookup(to, targetDir || to == "")
+		}
+	}
+	if file == nil && status == http.StatusOK && dir && s.cfg.Pages.Autoindex && s.serveAutoindex(w, r, site, name, rev, rel) {
+		return
+	}
+	if file == nil && status == http.StatusOK && s.cfg.Pages.SPA {
+		// Single-page apps route unknown paths in the browser.
+		if e, ok := site.entries[pathpkg.Join(site.root, "index.html")]; ok && e.Type == "blob" {
+			file = &e
+		}
+	}
+
+	if file != nil && s.allowed(r, rev, aclPath{path: file.Name}) {
+		if site.cname != "" && status == http.StatusOK && s.allowed(r, rev, aclPath{path: pathpkg.Join(site.root, "CNAME")}) {
+			canonical := url.URL{Scheme: "https", Host: site.cname, Path: "/" + subPath}
+			w.Header().Set("Link", "<"+canonical.String()+`>; rel="canonical"`)
+		}
+		s.servePagesFile(w, r, site, rev, *file, status)
+		return
+	}
+	if nf, ok := site.entries[pathpkg.Join(site.root, "404.html")]; ok && nf.Type == "blob" && s.allowed(r, rev, aclPath{path: nf.Name}) {
+		s.servePagesFile(w, r, site, rev, nf, http.StatusNotFound)
+		return
+	}
+	s.httpError(w, r, http.StatusNotFound, fmt.Sprintf("File not found in %s", name), nil)
+}
+
+// findPagesBranch finds the branch named by the longest prefix of p and
+// returns the rest as the path within it. Without a match it falls back to
+// gh-pages and the whole of p, if that branch exists. Branches the user
+// cannot see are treated as missing.
+func (s *Server) findPagesBranch(r *http.Request, p string) (branch, subPath string, found bool, err error) {
+	ctx := r.Context()
+	// Try progressively longer prefixes as potential branch names
+	// Start from the longest possible branch name (most segments)
+	segments := strings.Split(strings.TrimSuffix(p, "/"), "/")
+	for i := len(segments); i > 0; i-- {
+		potentialBranch := strings.Join(segments[:i], "/")
+		has, err := gitHasBranch(ctx, s.repoPath, potentialBranch)
+		if err != nil {
+			return "", "", false, err
+		}
+		if has && s.allowed(r, potentialBranch, aclPath{path: aclAny}) {
+			if i < len(segments) {
+				subPath = strings.Join(segments[i:], "/")
+			}
+			// Add trailing content if URL ended with slash
+			if strings.HasSuffix(p, "/") && subPath != "" {
+				subPath = subPath + "/"
+			}
+			return potentialBranch, subPath, true, nil
+		}
+	}
+	// If no valid branch found, default to gh-pages
+	has, err := gitHasBranch(ctx, s.repoPath, "gh-pages")
+	return "gh-pages", p, has && s.allowed(r, "gh-pages", aclPath{path: aclAny}), err
+}
+
+// parsePagesRef parses the explicit forms of a pages URL, which start with
+// a '~' that no ref name can contain:
+//
+//	~commit/{sha}/{path}
+//	~tag/{tag}/{path}
+//	~branch/{branch}/{path}
+//	~ref/refs/{...}/~/{path}
+//
+// A name with slashes must be followed by a '~' segment. It returns the
+// name to show, the revision to resolve and the path within it, and
+// explicit false for plain /pages/{branch}/{path} URLs. Notes are not
+// served.
+func parsePagesRef(p string) (name, rev, subPath string, explicit bool, err error) {
+	kind, rest, ok := strings.Cut(p, "/")
+	if !strings.HasPrefix(kind, "~") {
+		return "", "", "", false, nil
+	}
+	if !ok || rest == "" {
+		return "", "", "", true, errUnknownRef
+	}
+	if kind == "~commit" {
+		name, subPath, _ = strings.Cut(rest, "/")
+		if len(name) < 4 || len(name) > 64 || strings.Trim(strings.ToLower(name), "0123456789abcdef") != "" {
+			return "", "", "", true, errUnknownRef
+		}
+		return name, name, subPath, true, nil
+	}
+	segs := strings.Split(rest, "/")
+	end := slices.Index(segs, "~")
+	if end < 0 {
+		name, subPath, _ = strings.Cut(rest, "/")
+	} else {
+		name, subPath = strings.Join(segs[:end], "/"), strings.Join(segs[end+1:], "/")
+	}
+	switch kind {
+	case "~tag":
+		rev = "refs/tags/" + name
+	case "~branch":
+		rev = "refs/heads/" + name
+	case "~ref":
+		if !strings.HasPrefix(name, "refs/") || strings.HasPrefix(name, "refs/notes/") {
+			return "", "", "", true, errUnknownRef
+		}
+		rev = name
+	default:
+		return "", "", "", true, errUnknownRef
+	}
+	if !validRefName(name) {
+		return "", "", "", true, errUnknownRef
+	}
+	return name, rev, subPath, true, nil
+}
+
+// pagesSite is a commit being served as a static site the way GitHub Pages
+// would publish it.
+type pagesSite struct {
+	commit   string
+	prefix   string // URL path of the site root, ending in '/'
+	root     string // "docs" when published from the docs folder, else ""
+	cname    string // custom domain from the CNAME file
+	nojekyll bool   // whether a .nojekyll file turns off Jekyll's exclusions
+
+	redirects []redirectRule // from _redirects
+	headers   []headerRule   // from _headers
+
+	// entries holds the tree entries, by full path, of the files that may
+	// answer the request.
+	entries map[string]TreeEntry
+}
+
+// loadPagesSite looks up, in one git command, everything needed to answer a
+// request for rel: which folder the site is published from, its CNAME,
+// .nojekyll, _redirects and _headers files, its 404 page and the candidate
+// files for rel, with the precompressed copies of the files it may serve.
+func (s *Server) loadPagesSite(ctx context.Context, commit, rel string) (pagesSite, error) {
+	var paths []string
+	for _, root := range []string{"", "docs"} {
+		for _, p := range []string{"CNAME", ".nojekyll", "_redirects", "_headers"} {
+			paths = append(paths, pathpkg.Join(root, p))
+		}
+		served := append([]string{pathpkg.Join(root, "index.html"), pathpkg.Join(root, "404.html")}, pagesCandidates(root, rel)...)
+		paths = append(paths, withPrecompressed(served)...)
+	}
+	site := pagesSite{commit: commit, entries: make(map[string]TreeEntry)}
+	if err := s.addPagesEntries(ctx, &site, paths); err != nil {
+		return pagesSite{}, err
+	}
+	// Without an index.html at the top, a site with one in docs/ is
+	// published from there, like the "/docs" source of GitHub Pages.
+	if !site.isFile("index.html") && site.isFile("docs/index.html") {
+		site.root = "docs"
+	}
+	site.nojekyll = site.isFile(pathpkg.Join(site.root, ".nojekyll"))
+	if data, ok, err := s.readPagesFile(ctx, site, "CNAME", 1024); err != nil {
+		return pagesSite{}, err
+	} else if ok {
+		site.cname = parseCNAME(data)
+	}
+	if data, ok, err := s.readPagesFile(ctx, site, "_redirects", maxRulesFileSize); err != nil {
+		return pagesSite{}, err
+	} else if ok {
+		site.redirects = parseRedirects(data)
+	}
+	if data, ok, err := s.readPagesFile(ctx, site, "_headers", maxRulesFileSize); err != nil {
+		return pagesSite{}, err
+	} else if ok {
+		site.headers = parseHeaders(data)
+	}
+	return site, nil
+}
+
+// pagesCandidates returns the paths below root that may answer a request
+// for rel.
+func pagesCandidates(root, rel string) []string {
+	if rel == "" {
+		return nil
+	}
+	p := pathpkg.Join(root, rel)
+	return []string{p, p + ".html", p + "/index.html"}
+}
+
+// addPagesEntries adds the tree entries at paths to the site.
+func (s *Server) addPagesEntries(ctx context.Context, site *pagesSite, paths []string) error {
+	out, err := runGitRaw(ctx, s.repoPath, append([]string{"ls-tree", "-z", "-l", "--end-of-options", site.commit, "--"}, paths...)...)
+	if err != nil {
+		return err
+	}
+	for _, e := range parseLsTree(out) {
+		site.entries[e.Name] = e
+	}
+	return nil
+}
+
+// readPagesFile returns the content of the site's configuration file name
+// if it exists and is at most limit bytes long.
+func (s *Server) readPagesFile(ctx context.Context, site pagesSite, name string, limit int64) (string, bool, error) {
+	e, ok := site.entries[pathpkg.Join(site.root, name)]
+	if !ok || e.Type != "blob" || e.Size > limit {
+		return "", false, nil
+	}
+	data, err := gitShowFile(ctx, s.repoPath, e.Object)
+	if err != nil {
+		return "", false, err
+	}
+	return string(data), true, nil
+}
+
+// isFile reports whether p is a file of the site's commit.
+func (site pagesSite) isFile(p string) bool {
+	e, ok := site.entries[p]
+	return ok && e.Type == "blob"
+}
+
+// isDir reports whether p is a directory of the site's commit. ls-tree
+// lists the files looked up inside a directory rather than the directory.
+func (site pagesSite) isDir(p string) bool {
+	if e, ok := site.entries[p]; ok {
+		return e.IsDir()
+	}
+	for name := range site.entries {
+		if strings.HasPrefix(name, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the file that answers a request for rel, which dir says
+// was requested with a trailing slash. Like GitHub Pages it serves
+// index.html for directories, redirects directories requested without a
+// slash and tries rel.html for clean URLs. Redirect is true if the request
+// should be redirected to rel/.
+func (site pagesSite) lookup(rel string, dir bool) (file *TreeEntry, redirect bool) {
+	if rel == "_redirects" || rel == "_headers" || !site.nojekyll && jekyllExcluded(rel) {
+		return nil, false
+	}
+	p := pathpkg.Join(site.root, rel)
+	if dir {
+		p = pathpkg.Join(p, "index.html")
+	}
+	if e, ok := site.entries[p]; ok && e.Type == "blob" {
+		return &e, false
+	}
+	if !dir && site.isDir(p) {
+		return nil, true
+	}
+	if !dir && rel != "" {
+		if e, ok := site.entries[p+".html"]; ok && e.Type == "blob" {
+			return &e, false
+		}
+	}
+	return nil, false
+}
+
+// jekyllExcluded reports whether Jekyll leaves rel out of a site: files
+// and folders starting with '_', '.' or '#' or ending with '~'. A
+// .nojekyll file publishes them.
+func jekyllExcluded(rel string) bool {
+	if rel == "" {
+		return false
+	}
+	for _, seg := range strings.Split(rel, "/") {
+		if strings.HasPrefix(seg, "_") || strings.HasPrefix(seg, ".") || strings.HasPrefix(seg, "#") || strings.HasSuffix(seg, "~") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCNAME returns the custom domain named by a CNAME file, or "" if it
+// does not hold a plain host name.
+func parseCNAME(data string) string {
+	host, _, _ := strings.Cut(strings.TrimSpace(data), "\n")
+	host = strings.ToLower(strings.TrimSpace(host))
+	if host == "" || strings.ContainsAny(host, " /:@?#") {
+		return ""
+	}
+	return host
+}
+
+// servePagesFile sends a file of a pages site at rev with the given status.
+// A committed precompressed copy of the file is sent instead if the client
+// accepts its coding.
+func (s *Server) servePagesFile(w http.ResponseWriter, r *http.Request, site pagesSite, rev string, e TreeEntry, status int) {
+	// A site's _headers may have set the type.
+	if w.Header().Get("Content-Type") == "" {
+		contentType := mime.TypeByExtension(filepath.Ext(e.Name))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", contentType)
+	}
+	contentType := w.Header().Get("Content-Type")
+	rewrite := s.cfg.Pages.Rewrite && rewritable(contentType)
+	sync := wantsPagesSync(r, contentType)
+	if !rewrite && !sync && compressible(contentType) {
+		// Copies would miss the rewritten URLs and the added script.
+		copies := make(map[string]TreeEntry)
+		var codings []string
+		for _, pc := range precompressedFiles {
+			if c, ok := site.entries[e.Name+pc.ext]; ok && c.Type == "blob" && s.allowed(r, rev, aclPath{path: c.Name}) {
+				copies[pc.coding] = c
+				codings = append(codings, pc.coding)
+			}
+		}
+		if len(codings) > 0 {
+			varyEncoding(w.Header())
+		}
+		if coding := chooseEncoding(r, codings); coding != "" {
+			content, err := gitShowFile(r.Context(), s.repoPath, copies[coding].Object)
+			if err != nil {
+				s.httpError(w, r, http.StatusInternalServerError, "Failed to read file", err)
+				return
+			}
+			writePrecompressed(w, status, coding, content)
+			return
+		}
+	}
+	content, err := gitShowFile(r.Context(), s.repoPath, e.Object)
+	if err != nil {
+		s.httpError(w, r, http.StatusInternalServerError, "Failed to read file", err)
+		return
+	}
+	if rewrite {
+		dir := pathpkg.Dir(strings.TrimPrefix(e.Name, site.root+"/"))
+		if dir == "." {
+			dir = ""
+		} else {
+			dir += "/"
+		}
+		content = rewriteRootURLs(content, contentType, site.prefix, escapePath(dir))
+	}
+	if sync {
+		content = addPagesSync(content)
+	}
+	writeContent(w, r, status, content)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// schemeKey is the context key under which the scheme reported by a trusted
+// proxy is stored.
+type schemeKey struct{}
+
+// parseTrustedProxies parses IP addresses and CIDR ranges.
+func parseTrustedProxies(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// proxyHeaders applies X-Forwarded-For, X-Forwarded-Host,
+// X-Forwarded-Proto and X-Request-Id to requests arriving from a trusted
+// proxy, so that logs show the real client and the proxy's request ID and
+// generated absolute URLs use the public host and scheme. The headers are
+// ignored for all other peers.
+func proxyHeaders(next http.Handler, trusted []*net.IPNet) http.Handler {
+	isTrusted := func(ip net.IP) bool {
+		for _, n := range trusted {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer := net.ParseIP(clientIP(r))
+		if peer == nil || !isTrusted(peer) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r = r.Clone(r.Context())
+		// The client is the last address not added by one of our proxies.
+		if hops := splitList(strings.Join(r.Header.Values("X-Forwarded-For"), ",")); len(hops) > 0 {
+			client := ""
+			for i := len(hops) - 1; i >= 0; i-- {
+				ip := net.ParseIP(hops[i])
+				if ip == nil {
+					break
+				}
+				client = hops[i]
+				if !isTrusted(ip) {
+					break
+				}
+			}
+			if client != "" {
+				r.RemoteAddr = client
+			}
+		}
+		if host, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Host"), ","); host != "" {
+			r.Host = strings.TrimSpace(host)
+		}
+		if proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ","); proto != "" {
+			proto = strings.ToLower(strings.TrimSpace(proto))
+			if proto == "http" || proto == "https" {
+				r = r.WithContext(context.WithValue(r.Context(), schemeKey{}, proto))
+			}
+		}
+		if id := r.Header.Get("X-Request-Id"); validRequestID(id) {
+			r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the IP address of the client, without the port.
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// requestScheme returns "https" or "http" as seen by the client.
+func requestScheme(r *http.Request) string {
+	if scheme, ok := r.Context().Value(schemeKey{}).(string); ok {
+		return scheme
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// Limits on the _redirects and _headers files of a pages site.
+const (
+	maxRulesFileSize = 64 << 10
+	maxRules         = 1000
+)
+
+// redirectRule is a line of a Netlify-style _redirects file:
+//
+//	/from/:placeholder/*  /to/:placeholder/:splat  301!
+type redirectRule struct {
+	from   []string // pattern segments
+	to     string
+	status int  // 3xx redirects; 200 and 404 rewrite to a file of the site
+	force  bool // applies even if a file exists at the path
+}
+
+// headerRule is a block of a Netlify-style _headers file: a path pattern
+// followed by indented headers.
+type headerRule struct {
+	from   []string
+	header http.Header
+}
+
+// forbiddenPageHeaders may not be set by a site's _headers file: they
+// would break the response or reach beyond the site, for example by
+// setting the viewer's cookies or clearing its storage.
+var forbiddenPageHeaders = map[string]bool{
+	"Clear-Site-Data":           true,
+	"Connection":                true,
+	"Content-Encoding":          true,
+	"Content-Length":            true,
+	"Service-Worker-Allowed":    true,
+	"Set-Cookie":                true,
+	"Strict-Transport-Security": true,
+	"Transfer-Encoding":         true,
+	"Www-Authenticate":          true,
+	"X-Request-Id":              true,
+}
+
+// forbiddenPageHeaderPrefixes are header families a site's _headers file
+// may not set either. CORS headers would let other origins read the
+// viewer's responses with the visitor's credentials, and Cross-Origin-*
+// policies change how the viewer's origin is isolated.
+var forbiddenPageHeaderPrefixes = []string{"Access-Control-", "Cross-Origin-"}
+
+// forbiddenPageHeader reports whether a _headers file may not set the
+// header with canonical name.
+func forbiddenPageHeader(name string) bool {
+	if forbiddenPageHeaders[name] {
+		return true
+	}
+	for _, prefix := range forbiddenPageHeaderPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRedirects parses a _redirects file. Lines it cannot honour, such as
+// proxying to another host or conditions on country, role or query
+// parameters, are skipped.
+func parseRedirects(data string) []redirectRule {
+	var rules []redirectRule
+	sc := bufio.NewScanner(strings.NewReader(data))
+	for sc.Scan() && len(rules) < maxRules {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "/") {
+			continue
+		}
+		rule := redirectRule{from: splitPattern(fields[0]), to: fields[1], status: http.StatusMovedPermanently}
+		if len(fields) > 3 {
+			continue // conditions
+		}
+		if len(fields) == 3 {
+			code, force := strings.CutSuffix(fields[2], "!")
+			n, err := strconv.Atoi(code)
+			if err != nil {
+				continue // query parameter match
+			}
+			rule.status, rule.force = n, force
+		}
+		local := strings.HasPrefix(rule.to, "/")
+		switch {
+		case rule.status >= 300 && rule.status < 400:
+			if !local && !strings.HasPrefix(rule.to, "https://") && !strings.HasPrefix(rule.to, "http://") {
+				continue
+			}
+		case rule.status == http.StatusOK || rule.status == http.StatusNotFound:
+			if !local {
+				continue // proxying
+			}
+		default:
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// parseHeaders parses a _headers file.
+func parseHeaders(data string) []headerRule {
+	var rules []headerRule
+	sc := bufio.NewScanner(strings.NewReader(data))
+	for sc.Scan() {
+		text := sc.Text()
+		line := strings.TrimSpace(text)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if text[0] != ' ' && text[0] != '\t' {
+			if len(rules) == maxRules {
+				break
+			}
+			rules = append(rules, headerRule{from: splitPattern(line), header: make(http.Header)})
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || len(rules) == 0 {
+			continue
+		}
+		name = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))
+		if name == "" || strings.ContainsAny(name, " \t") || forbiddenPageHeader(name) {
+			continue
+		}
+		rules[len(rules)-1].header.Add(name, strings.TrimSpace(value))
+	}
+	return rules
+}
+
+// splitPattern splits a path or pattern into segments, ignoring a
+// trailing slash.
+func splitPattern(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// matchPattern matches the path against pattern segments. A ":name"
+// segment matches one segment and a final "*" the rest of the path, which
+// are returned as placeholders, the rest as "splat".
+func matchPattern(pattern []string, path string) (map[string]string, bool) {
+	segs := splitPattern(path)
+	params := make(map[string]string)
+	for i, p := range pattern {
+		if p == "*" && i == len(pattern)-1 {
+			params["splat"] = strings.Join(segs[min(i, len(segs)):], "/")
+			return params, true
+		}
+		if i >= len(segs) {
+			return nil, false
+		}
+		switch {
+		case strings.HasPrefix(p, ":"):
+			params[p[1:]] = segs[i]
+		case p != segs[i]:
+			return nil, false
+		}
+	}
+	return params, len(segs) == len(pattern)
+}
+
+// expand replaces the placeholders of a rule's target. A placeholder
+// starts a segment and may be followed by more text, as in ":slug.html".
+func (rule redirectRule) expand(params map[string]string) string {
+	segs := strings.Split(rule.to, "/")
+	for i, seg := range segs {
+		name, ok := strings.CutPrefix(seg, ":")
+		if !ok {
+			continue
+		}
+		end := strings.IndexFunc(name, func(c rune) bool {
+			return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_')
+		})
+		if end < 0 {
+			end = len(name)
+		}
+		if v, ok := params[name[:end]]; ok {
+			segs[i] = v + name[end:]
+		}
+	}
+	return strings.Join(segs, "/")
+}
+
+// matchRedirect returns the first rule for path and its expanded target.
+// Rules that are not forced only apply if exists is false.
+func matchRedirect(rules []redirectRule, path string, exists bool) (redirectRule, string, bool) {
+	for _, rule := range rules {
+		if exists && !rule.force {
+			continue
+		}
+		if params, ok := matchPattern(rule.from, path); ok {
+			return rule, rule.expand(params), true
+		}
+	}
+	return redirectRule{}, "", false
+}
+
+// applyHeaders adds the headers of every rule matching path. A site's
+// Content-Security-Policy is added to the one already set, so it can only
+// restrict the response further.
+func applyHeaders(h http.Header, rules []headerRule, path string) {
+	for _, rule := range rules {
+		if _, ok := matchPattern(rule.from, path); !ok {
+			continue
+		}
+		for name, values := range rule.header {
+			if name != "Content-Security-Policy" {
+				h.Del(name)
+			}
+			for _, v := range values {
+				h.Add(name, v)
+			}
+		}
+	}
+}
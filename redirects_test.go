@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRedirects(t *testing.T) {
+	rules := parseRedirects(`# comment
+/old        /new
+/blog/:year/:slug  /posts/:year-:slug.html  302
+/docs/*     /guide/:splat   301!
+/app/*      /index.html     200
+/gone       /404.html       404   # trailing comment
+/ext        https://example.com/  307
+not-a-path  /x
+/short
+/proxy      https://api.example.com/  200
+/scheme     javascript:alert(1)  302
+/other      ftp://example.com/  301
+/cond       /x  302  Country=de
+/query      id=:id  /x
+/teapot     /x  418
+/bad        /x  abc
+`)
+	want := []redirectRule{
+		{from: []string{"old"}, to: "/new", status: 301},
+		{from: []string{"blog", ":year", ":slug"}, to: "/posts/:year-:slug.html", status: 302},
+		{from: []string{"docs", "*"}, to: "/guide/:splat", status: 301, force: true},
+		{from: []string{"app", "*"}, to: "/index.html", status: 200},
+		{from: []string{"gone"}, to: "/404.html", status: 404},
+		{from: []string{"ext"}, to: "https://example.com/", status: 307},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("parseRedirects =\n%+v\nwant\n%+v", rules, want)
+	}
+}
+
+func TestParseRedirectsLimit(t *testing.T) {
+	rules := parseRedirects(strings.Repeat("/a /b\n", maxRules+10))
+	if len(rules) != maxRules {
+		t.Errorf("parsed %d rules, want %d", len(rules), maxRules)
+	}
+}
+
+func TestMatchRedirect(t *testing.T) {
+	rules := parseRedirects(`
+/blog/:year/:slug  /posts/:year/:slug.html  302
+/docs/*            /guide/:splat   301!
+/                  /home           301
+/app/*             /index.html     200
+/search            /find?q=all     302
+`)
+	tests := []struct {
+		path   string
+		exists bool
+		status int
+		target string
+	}{
+		{"/blog/2024/hello", false, 302, "/posts/2024/hello.html"},
+		{"/blog/2024/hello/", false, 302, "/posts/2024/hello.html"},
+		{"/blog/2024", false, 0, ""},
+		{"/blog/2024/hello/more", false, 0, ""},
+		{"/docs/a/b.html", false, 301, "/guide/a/b.html"},
+		{"/docs/a/b.html", true, 301, "/guide/a/b.html"}, // forced
+		{"/docs", false, 301, "/guide/"},
+		{"/", false, 301, "/home"},
+		{"/", true, 0, ""}, // not forced
+		{"/app/settings/profile", false, 200, "/index.html"},
+		{"/search", false, 302, "/find?q=all"},
+		{"/unknown", false, 0, ""},
+	}
+	for _, tt := range tests {
+		rule, target, ok := matchRedirect(rules, tt.path, tt.exists)
+		if tt.status == 0 {
+			if ok {
+				t.Errorf("matchRedirect(%q, %v) = %d %q, want no match", tt.path, tt.exists, rule.status, target)
+			}
+			continue
+		}
+		if !ok || rule.status != tt.status || target != tt.target {
+			t.Errorf("matchRedirect(%q, %v) = %d %q %v, want %d %q", tt.path, tt.exists, rule.status, target, ok, tt.status, tt.target)
+		}
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	rules := parseHeaders(`# comment
+/*
+  X-Frame-Options: DENY
+  x-custom-header:  a: b
+  Set-Cookie: session=stolen
+  Content-Length: 1
+  Access-Control-Allow-Origin: *
+  access-control-allow-credentials: true
+  Cross-Origin-Resource-Policy: cross-origin
+  Cross-Origin-Opener-Policy: unsafe-none
+  Bad Name: x
+  no colon
+
+/assets/*
+	Cache-Control: public, max-age=31536000
+	Cache-Control: immutable
+  Indented: before any path is ignored only at the top
+`)
+	want := []headerRule{
+		{from: []string{"*"}, header: http.Header{"X-Frame-Options": {"DENY"}, "X-Custom-Header": {"a: b"}}},
+		{from: []string{"assets", "*"}, header: http.Header{
+			"Cache-Control": {"public, max-age=31536000", "immutable"},
+			"Indented":      {"before any path is ignored only at the top"},
+		}},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("parseHeaders =\n%+v\nwant\n%+v", rules, want)
+	}
+	if rules := parseHeaders("  X-Orphan: 1\n/x\n"); len(rules) != 1 || len(rules[0].header) != 0 {
+		t.Errorf("header before the first path: %+v", rules)
+	}
+}
+
+func TestApplyHeaders(t *testing.T) {
+	rules := parseHeaders(`
+/*
+  Content-Security-Policy: img-src 'self'
+  X-Frame-Options: SAMEORIGIN
+/admin/*
+  X-Frame-Options: DENY
+  X-Robots-Tag: noindex
+`)
+	h := http.Header{}
+	h.Set("Content-Security-Policy", "sandbox")
+	h.Set("X-Frame-Options", "ALLOWALL")
+	applyHeaders(h, rules, "/admin/index.html")
+	want := http.Header{
+		// Site policies only add restrictions.
+		"Content-Security-Policy": {"sandbox", "img-src 'self'"},
+		"X-Frame-Options":         {"DENY"},
+		"X-Robots-Tag":            {"noindex"},
+	}
+	if !reflect.DeepEqual(h, want) {
+		t.Errorf("headers = %v, want %v", h, want)
+	}
+
+	h = http.Header{}
+	applyHeaders(h, rules, "/index.html")
+	if h.Get("X-Frame-Options") != "SAMEORIGIN" || h.Get("X-Robots-Tag") != "" {
+		t.Errorf("headers = %v", h)
+	}
+}
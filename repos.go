@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// repoNamePattern restricts repository names to characters that are safe to
+// use as a URL path segment and as a ServeMux pattern.
+var repoNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// defaultDescription is the placeholder git writes to .git/description.
+const defaultDescription = "Unnamed repository; edit this file 'description' to name the repository."
+
+// Hub serves one or more repositories. With a single repository its pages
+// are served at the root; otherwise each repository lives under /{name}/
+// and / lists all of them. Everything is served below the configured base
+// path.
+type Hub struct {
+	repos []*Server
+	multi bool
+	root  string // base path of the whole site, "" or e.g. "/git"
+	tmpls map[string]*template.Template
+}
+
+// RepoSummary describes a repository on the repository index page.
+type RepoSummary struct {
+	Name         string
+	URL          string
+	Description  string
+	LastActivity string
+}
+
+// ReposData contains data for the repository index page.
+type ReposData struct {
+	BaseData
+	Repos []RepoSummary
+}
+
+// newHub constructs a Hub for the given repositories. In multi-repo mode
+// every repository is namespaced under /{name} and names must be unique.
+func newHub(repos []*Server, tmpls map[string]*template.Template, multi bool) (*Hub, error) {
+	if len(repos) == 0 {
+		return nil, fmt.Errorf("no repositories to serve")
+	}
+	if len(repos) > 1 {
+		multi = true
+	}
+	root := repos[0].cfg.BasePath
+	repos[0].basePath = root
+	if multi {
+		seen := make(map[string]string)
+		for _, srv := range repos {
+			if !repoNamePattern.MatchString(srv.repoName) {
+				return nil, fmt.Errorf("repository name %q (%s) must only contain letters, digits, '.', '_' and '-'", srv.repoName, srv.repoPath)
+			}
+			if other, ok := seen[srv.repoName]; ok {
+				return nil, fmt.Errorf("duplicate repository name %q (%s and %s)", srv.repoName, other, srv.repoPath)
+			}
+			seen[srv.repoName] = srv.repoPath
+			srv.basePath = root + "/" + srv.repoName
+			srv.multiRepo = true
+		}
+		// Names taken from directories escape the config's check that no
+		// repository is served at another one's clone URL.
+		for _, srv := range repos {
+			if other, ok := seen[srv.repoName+".git"]; ok && srv.cfg.Features.Clone {
+				return nil, fmt.Errorf("repository name %q (%s) clashes with the clone URL of %q (%s); rename one of them or disable clone", srv.repoName+".git", other, srv.repoName, srv.repoPath)
+			}
+		}
+		sort.Slice(repos, func(i, j int) bool { return repos[i].repoName < repos[j].repoName })
+	}
+	return &Hub{repos: repos, multi: multi, root: root, tmpls: tmpls}, nil
+}
+
+// routes builds the HTTP handler tree for all repositories.
+func (h *Hub) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(h.root+"/static/app.css", withRoute("/static/", http.HandlerFunc(handleAppCSS)))
+	mux.Handle(h.root+"/static/app.js", withRoute("/static/", http.HandlerFunc(handleAppJS)))
+	if m := h.repos[0].cfg.Metrics; m.Enabled && m.Listen == "" {
+		mux.Handle(h.root+"/metrics", withRoute("/metrics", http.HandlerFunc(handleMetrics)))
+	}
+	for _, srv := range h.repos {
+		if srv.cfg.Features.Clone {
+			clone := withTimeout(srv.cfg.Timeouts.Clone, http.HandlerFunc(srv.handleSmartHTTP))
+			mux.Handle(srv.cloneURLPath()+"/", withRoute("/{repo}.git/", srv.guardClone(clone)))
+		}
+	}
+	if !h.multi {
+		mux.Handle(h.root+"/", http.StripPrefix(h.root, h.repos[0].guard(h.repos[0].routes())))
+		return mux
+	}
+	mux.Handle(h.root+"/{$}", withRoute("/", withTimeout(h.repos[0].cfg.Timeouts.Git, http.HandlerFunc(h.handleRepoIndex))))
+	mux.HandleFunc(h.root+"/", h.handleNotFound)
+	for _, srv := range h.repos {
+		mux.Handle(srv.basePath+"/", http.StripPrefix(srv.basePath, srv.guard(srv.routes())))
+	}
+	return mux
+}
+
+// handleRepoIndex renders the list of served repositories.
+func (h *Hub) handleRepoIndex(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	data := ReposData{BaseData: BaseData{Root: h.root, MultiRepo: true, User: userFromContext(ctx)}}
+	for _, srv := range h.repos {
+		if !srv.visibleRepo(r) {
+			continue
+		}
+		data.Repos = append(data.Repos, RepoSummary{
+			Name:         srv.title(),
+			URL:          srv.basePath + "/",
+			Description:  srv.repoDescription(ctx),
+			LastActivity: gitLastActivity(ctx, srv.repoPath),
+		})
+	}
+
+	t, ok := h.tmpls["repos"]
+	if !ok {
+		slog.ErrorContext(r.Context(), "template not found", "template", "repos")
+		http.Error(w, "template not found", http.StatusInternalServerError)
+		return
+	}
+	if err := t.ExecuteTemplate(w, "repos", data); err != nil {
+		slog.ErrorContext(r.Context(), "render template", "template", "repos", "err", err)
+	}
+}
+
+// handleNotFound answers paths outside all repositories.
+func (h *Hub) handleNotFound(w http.ResponseWriter, r *http.Request) {
+	writeNotFound(w, r, h.tmpls, h.root, h.multi)
+}
+
+// scanRepos returns the paths of all Git repositories, including bare ones,
+// found directly inside dir.
+func scanRepos(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		p := filepath.Join(dir, e.Name())
+		if isRepoDir(p) {
+			paths = append(paths, p)
+		}
+	}
+	return paths, nil
+}
+
+// isRepoDir reports whether dir looks like a Git worktree or bare repository.
+func isRepoDir(dir string) bool {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		return true
+	}
+	for _, name := range []string{"HEAD", "objects", "refs"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// repoDescription returns the configured description or, failing that, the
+// contents of the repository's description file.
+func (s *Server) repoDescription(ctx context.Context) string {
+	if s.description != "" {
+		return s.description
+	}
+	return gitDescription(ctx, s.repoPath)
+}
+
+// gitDescription returns the contents of the repository's description file,
+// ignoring git's default placeholder.
+func gitDescription(ctx context.Context, repoPath string) string {
+	gitDir, err := runGit(ctx, repoPath, "rev-parse", "--absolute-git-dir")
+	if err != nil {
+		return ""
+	}
+	b, err := os.ReadFile(filepath.Join(strings.TrimSpace(gitDir), "description"))
+	if err != nil {
+		return ""
+	}
+	desc := strings.TrimSpace(string(b))
+	if desc == defaultDescription {
+		return ""
+	}
+	return desc
+}
+
+// gitLastActivity returns the date of the most recent commit on any branch.
+func gitLastActivity(ctx context.Context, repoPath string) string {
+	out, err := runGit(ctx, repoPath, "for-each-ref", "--sort=-committerdate", "--count=1", "--format=%(committerdate:short)", "refs/heads")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(out)
+}
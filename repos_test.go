@@ -0,0 +1,24 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewHubCloneURLClash(t *testing.T) {
+	repos := func(clone bool) []*Server {
+		cfg := defaultConfig()
+		cfg.Features.Clone = clone
+		return []*Server{
+			{repoPath: "/srv/x", repoName: "x", cfg: cfg},
+			{repoPath: "/srv/x.git/worktree", repoName: "x.git", cfg: cfg},
+		}
+	}
+	if _, err := newHub(repos(false), nil, true); err != nil {
+		t.Fatalf("without clone: %v", err)
+	}
+	_, err := newHub(repos(true), nil, true)
+	if err == nil || !strings.Contains(err.Error(), `"x.git" (/srv/x.git/worktree) clashes with the clone URL of "x" (/srv/x)`) {
+		t.Errorf("newHub = %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	pathpkg "path"
+	"strings"
+)
+
+// errUnknownRef is returned for refs that are malformed or name no commit.
+var errUnknownRef = errors.New("unknown ref")
+
+// errInvalidPath is returned for paths that try to leave the repository or
+// would be read by git as something other than a plain path.
+var errInvalidPath = errors.New("invalid path")
+
+// resolvedRef is a ref from a request and the commit it named when the
+// request was resolved. Git commands are only ever given Commit, so a ref
+// cannot be mistaken for an option and every command of a request sees the
+// same commit even if the ref moves meanwhile.
+type resolvedRef struct {
+	Name   string // as requested, used for links and access control
+	Commit string // full object ID
+}
+
+// validRefName reports whether ref may be passed to rev-parse. It rejects
+// option-like names, ranges, reflog selectors such as @{1}, the :/message
+// and :path syntaxes and names git itself refuses, like ones ending in
+// ".lock".
+func validRefName(ref string) bool {
+	if ref == "" || len(ref) > 256 || strings.HasPrefix(ref, "-") || strings.HasPrefix(ref, ":") ||
+		strings.Contains(ref, "..") || strings.Contains(ref, "@{") {
+		return false
+	}
+	for _, c := range ref {
+		if c <= ' ' || c == 0x7f {
+			return false
+		}
+	}
+	for _, part := range strings.Split(ref, "/") {
+		if strings.HasSuffix(part, ".lock") {
+			return false
+		}
+	}
+	return true
+}
+
+// resolveRef validates ref and resolves it to a commit.
+func (s *Server) resolveRef(ctx context.Context, ref string) (resolvedRef, error) {
+	if !validRefName(ref) {
+		return resolvedRef{}, errUnknownRef
+	}
+	commit, err := gitResolveCommit(ctx, s.repoPath, ref)
+	if err != nil {
+		return resolvedRef{}, err
+	}
+	return resolvedRef{Name: ref, Commit: commit}, nil
+}
+
+// queryRef resolves the ref named by the query parameter key, or the
+// default ref if it is empty. Refs the user may not see at all are
+// reported as unknown, like refs that do not exist.
+func (s *Server) queryRef(r *http.Request, key string) (resolvedRef, error) {
+	ref := r.URL.Query().Get(key)
+	if ref == "" {
+		def, err := s.resolveDefaultRef(r.Context())
+		if err != nil {
+			return resolvedRef{}, err
+		}
+		ref = def
+	}
+	if !validRefName(ref) || !s.allowed(r, ref, aclPath{path: aclAny}) {
+		return resolvedRef{}, errUnknownRef
+	}
+	return s.resolveRef(r.Context(), ref)
+}
+
+// cleanPath normalizes a repository path from a request. It returns "" for
+// the top-level directory and errInvalidPath for paths that are not clean,
+// such as ones with ".." segments.
+func cleanPath(p string) (string, error) {
+	p = strings.TrimSuffix(normalizeRepoPath(p), "/")
+	if p == "" {
+		return "", nil
+	}
+	if pathpkg.Clean(p) != p || p == ".." || strings.HasPrefix(p, "../") || strings.HasPrefix(p, ":") {
+		return "", errInvalidPath
+	}
+	for _, c := range p {
+		if c < ' ' || c == 0x7f {
+			return "", errInvalidPath
+		}
+	}
+	return p, nil
+}
+
+// resolveError answers a request whose ref or path could not be resolved:
+// 404 for unknown refs, 400 for invalid paths and 500 if git failed.
+func (s *Server) resolveError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, errUnknownRef):
+		s.httpError(w, r, http.StatusNotFound, "Unknown ref", nil)
+	case errors.Is(err, errInvalidPath):
+		s.httpError(w, r, http.StatusBadRequest, "Invalid path", nil)
+	default:
+		s.httpError(w, r, http.StatusInternalServerError, "Failed to resolve ref", err)
+	}
+}
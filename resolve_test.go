@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestRepo creates a repository with two commits on main and a branch
+// feature/ui, and returns its path.
+func newTestRepo(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir := t.TempDir()
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_NOSYSTEM=1",
+			"GIT_AUTHOR_NAME=Test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=Test", "GIT_COMMITTER_EMAIL=test@example.com")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+		}
+	}
+	git("init", "-q", "-b", "main")
+	for _, content := range []string{"one\n", "two\n"} {
+		if err := os.WriteFile(filepath.Join(dir, "README"), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		git("add", "README")
+		git("commit", "-q", "-m", strings.TrimSpace(content))
+	}
+	git("branch", "feature/ui")
+	return dir
+}
+
+func TestValidRefName(t *testing.T) {
+	tests := map[string]bool{
+		"main":                   true,
+		"feature/ui":             true,
+		"v1.0":                   true,
+		"main~1":                 true,
+		"main^":                  true,
+		"HEAD":                   true,
+		"0123abcd":               true,
+		"":                       false,
+		"-x":                     false,
+		"--end-of-options":       false,
+		"--output=/tmp/x":        false,
+		":README":                false,
+		":/fix":                  false,
+		"main..feature":          false,
+		"main...feature":         false,
+		"a/../../b":              false,
+		"main@{1}":               false,
+		"@{-1}":                  false,
+		"main@{yesterday}":       false,
+		"x.lock":                 false,
+		"refs/heads/x.lock":      false,
+		"x.lock/y":               false,
+		"x.locked":               true,
+		"a b":                    false,
+		"a\x00b":                 false,
+		"a\nb":                   false,
+		"a\x7fb":                 false,
+		strings.Repeat("a", 257): false,
+	}
+	for ref, want := range tests {
+		if got := validRefName(ref); got != want {
+			t.Errorf("validRefName(%q) = %v, want %v", ref, got, want)
+		}
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		in, want string
+		err      bool
+	}{
+		{"", "", false},
+		{"/", "", false},
+		{"README", "README", false},
+		{"/docs/a.md", "docs/a.md", false},
+		{"docs/", "docs", false},
+		{`docs\a.md`, "docs/a.md", false},
+		{"..", "", true},
+		{"../etc/passwd", "", true},
+		{"a/../../b", "", true},
+		{"a/../b", "", true},
+		{"a//b", "", true},
+		{"./a", "", true},
+		{":README", "", true},
+		{"a\x00b", "", true},
+		{"a\nb", "", true},
+	}
+	for _, tt := range tests {
+		got, err := cleanPath(tt.in)
+		if got != tt.want || (err != nil) != tt.err {
+			t.Errorf("cleanPath(%q) = %q, %v", tt.in, got, err)
+		}
+		if err != nil && !errors.Is(err, errInvalidPath) {
+			t.Errorf("cleanPath(%q) error %v is not errInvalidPath", tt.in, err)
+		}
+	}
+
+	// Percent-encoded slashes and dots are decoded before the checks.
+	for _, query := range []string{"path=..%2F..%2Fetc", "path=%2e%2e", "path=a%2F..%2F..%2Fb", "path=a%00b"} {
+		r := httptest.NewRequest(http.MethodGet, "/tree?"+query, nil)
+		if p, err := cleanPath(r.URL.Query().Get("path")); err == nil {
+			t.Errorf("cleanPath for %s = %q", query, p)
+		}
+	}
+	r := httptest.NewRequest(http.MethodGet, "/tree?path=docs%2Fa.md", nil)
+	if p, err := cleanPath(r.URL.Query().Get("path")); p != "docs/a.md" || err != nil {
+		t.Errorf("cleanPath for docs%%2Fa.md = %q, %v", p, err)
+	}
+}
+
+func TestQueryRef(t *testing.T) {
+	repo := newTestRepo(t)
+	s := &Server{repoPath: repo, cfg: defaultConfig()}
+	head, err := gitResolveCommit(context.Background(), repo, "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent, err := gitResolveCommit(context.Background(), repo, "main~1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query  string
+		name   string
+		commit string
+	}{
+		{"", "main", head},
+		{"ref=main", "main", head},
+		{"ref=main~1", "main~1", parent},
+		{"ref=feature%2Fui", "feature/ui", head},
+		{"ref=" + head, head, head},
+		{"ref=-x", "", ""},
+		{"ref=--end-of-options", "", ""},
+		{"ref=%2Dx", "", ""},
+		{"ref=main..feature%2Fui", "", ""},
+		{"ref=main@%7B1%7D", "", ""},
+		{"ref=main.lock", "", ""},
+		{"ref=:README", "", ""},
+		{"ref=main%00", "", ""},
+		{"ref=nope", "", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/tree?"+tt.query, nil)
+		got, err := s.queryRef(r, "ref")
+		if tt.name == "" {
+			if !errors.Is(err, errUnknownRef) {
+				t.Errorf("queryRef(%s) = %+v, %v; want errUnknownRef", tt.query, got, err)
+			}
+			continue
+		}
+		if err != nil || got.Name != tt.name || got.Commit != tt.commit {
+			t.Errorf("queryRef(%s) = %+v, %v; want %s at %s", tt.query, got, err, tt.name, tt.commit)
+		}
+	}
+
+	// Refs hidden by the ACL look like refs that do not exist.
+	s.acl = newACL(nil, []ACLRule{{Allow: true, Who: []string{"*"}, Repos: []string{"*"}, Refs: []string{"main"}, Paths: []string{"**"}}})
+	r := httptest.NewRequest(http.MethodGet, "/tree?ref=feature%2Fui", nil)
+	if got, err := s.queryRef(r, "ref"); !errors.Is(err, errUnknownRef) {
+		t.Errorf("queryRef of hidden ref = %+v, %v; want errUnknownRef", got, err)
+	}
+	r = httptest.NewRequest(http.MethodGet, "/tree?ref=main", nil)
+	if got, err := s.queryRef(r, "ref"); err != nil || got.Commit != head {
+		t.Errorf("queryRef of visible ref = %+v, %v", got, err)
+	}
+}
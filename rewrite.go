@@ -0,0 +1,88 @@
+package main
+
+import (
+	"html"
+	"mime"
+	"regexp"
+	"strings"
+)
+
+// Patterns for root-relative URLs, which start with one slash but not two.
+// They work on the source text rather than a parsed document, so URLs that
+// scripts assemble at run time are left alone.
+var (
+	// href="/x", src='/x', action=/x and other attributes holding a URL.
+	rootAttrRE = regexp.MustCompile(`(?i)(\s(?:href|src|action|formaction|poster|data|background|manifest|cite|xlink:href)\s*=\s*["']?)/([^/])`)
+	// srcset="/a.png 1x, /b.png 2x"
+	srcsetRE = regexp.MustCompile(`(?i)(\ssrcset\s*=\s*)("[^"]*"|'[^']*')`)
+	// <meta http-equiv="refresh" content="0; url=/x">
+	refreshRE = regexp.MustCompile(`(?i)(\scontent\s*=\s*["'][^"']*url=)/([^/])`)
+	// url(/x) and url("/x") in stylesheets and style attributes.
+	cssURLRE = regexp.MustCompile(`(?i)(url\(\s*["']?)/([^/])`)
+	// @import "/x.css"
+	cssImportRE = regexp.MustCompile(`(?i)(@import\s+["'])/([^/])`)
+
+	baseTagRE = regexp.MustCompile(`(?i)<base[\s>]`)
+	headTagRE = regexp.MustCompile(`(?i)<head(?:\s[^>]*)?>`)
+)
+
+// rewritable reports whether rewriteRootURLs changes content of the given
+// type.
+func rewritable(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "text/css" || mediaType == "text/html" || mediaType == "application/xhtml+xml"
+}
+
+// rewriteRootURLs makes root-relative URLs in an HTML or CSS file of a
+// pages site point below prefix, the escaped URL path of the site root
+// ending in '/', for sites built to be served at the root of a domain. HTML
+// gets a <base> tag for dir, the escaped directory of the file within the
+// site, unless it has one, so that relative URLs keep working when the
+// file is served for another path by a rewrite rule. Other content is
+// returned unchanged.
+func rewriteRootURLs(content []byte, contentType, prefix, dir string) []byte {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	repl := []byte("${1}" + strings.ReplaceAll(prefix, "$", "$$") + "${2}")
+	switch mediaType {
+	case "text/css":
+		content = cssURLRE.ReplaceAll(content, repl)
+		return cssImportRE.ReplaceAll(content, repl)
+	case "text/html", "application/xhtml+xml":
+	default:
+		return content
+	}
+
+	// Attribute values are HTML; <style> blocks, which the CSS patterns
+	// also match, are not, and an escaped path needs no quoting in CSS.
+	attrPrefix := html.EscapeString(prefix)
+	attrRepl := []byte("${1}" + strings.ReplaceAll(attrPrefix, "$", "$$") + "${2}")
+	hasBase := baseTagRE.Match(content)
+	for _, re := range []*regexp.Regexp{rootAttrRE, refreshRE} {
+		content = re.ReplaceAll(content, attrRepl)
+	}
+	for _, re := range []*regexp.Regexp{cssURLRE, cssImportRE} {
+		content = re.ReplaceAll(content, repl)
+	}
+	content = srcsetRE.ReplaceAllFunc(content, func(m []byte) []byte {
+		sub := srcsetRE.FindSubmatch(m)
+		value := string(sub[2])
+		quote, list := value[:1], value[1:len(value)-1]
+		candidates := strings.Split(list, ",")
+		for i, c := range candidates {
+			trimmed := strings.TrimLeft(c, " \t\n")
+			if strings.HasPrefix(trimmed, "/") && !strings.HasPrefix(trimmed, "//") {
+				candidates[i] = c[:len(c)-len(trimmed)] + attrPrefix + trimmed[1:]
+			}
+		}
+		return []byte(string(sub[1]) + quote + strings.Join(candidates, ",") + quote)
+	})
+	if hasBase {
+		return content
+	}
+
+	base := []byte(`<base href="` + html.EscapeString(prefix+dir) + `">`)
+	if loc := headTagRE.FindIndex(content); loc != nil {
+		return append(content[:loc[1]:loc[1]], append(base, content[loc[1]:]...)...)
+	}
+	return append(base, content...)
+}
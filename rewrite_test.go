@@ -0,0 +1,58 @@
+package main
+
+import "testing"
+
+func TestRewriteRootURLs(t *testing.T) {
+	const prefix = "/pages/main/"
+	tests := []struct {
+		name, contentType, content, want string
+	}{
+		{"attributes", "text/html",
+			`<a href="/about.html">a</a><img src='/img.png'><form action=/send>`,
+			`<base href="/pages/main/"><a href="/pages/main/about.html">a</a><img src='/pages/main/img.png'><form action=/pages/main/send>`},
+		{"protocol-relative and relative", "text/html",
+			`<a href="//example.com/x">a</a><a href="about.html">b</a>`,
+			`<base href="/pages/main/"><a href="//example.com/x">a</a><a href="about.html">b</a>`},
+		{"srcset", "text/html",
+			`<img srcset="/a.png 1x, //cdn/b.png 2x, /c.png 3x">`,
+			`<base href="/pages/main/"><img srcset="/pages/main/a.png 1x, //cdn/b.png 2x, /pages/main/c.png 3x">`},
+		{"meta refresh", "text/html",
+			`<meta http-equiv="refresh" content="0; url=/new.html">`,
+			`<base href="/pages/main/"><meta http-equiv="refresh" content="0; url=/pages/main/new.html">`},
+		{"base after head", "text/html",
+			`<html><head lang="en"><title>x</title></head></html>`,
+			`<html><head lang="en"><base href="/pages/main/"><title>x</title></head></html>`},
+		{"existing base", "text/html",
+			`<head><base href="/"><link href="/s.css"></head>`,
+			`<head><base href="/pages/main/"><link href="/pages/main/s.css"></head>`},
+		{"style block", "text/html",
+			`<head><style>@import "/a.css"; p { background: url(/b.png) }</style></head>`,
+			`<head><base href="/pages/main/"><style>@import "/pages/main/a.css"; p { background: url(/pages/main/b.png) }</style></head>`},
+		{"stylesheet", "text/css; charset=utf-8",
+			`@import '/a.css'; p { background: url("/b.png") } q { background: url(//cdn/c.png) }`,
+			`@import '/pages/main/a.css'; p { background: url("/pages/main/b.png") } q { background: url(//cdn/c.png) }`},
+		{"other type", "application/javascript",
+			`fetch("/api")`,
+			`fetch("/api")`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(rewriteRootURLs([]byte(tt.content), tt.contentType, prefix, ""))
+			if got != tt.want {
+				t.Errorf("rewriteRootURLs(%q) =\n%s\nwant\n%s", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteRootURLsEscapesPrefix(t *testing.T) {
+	// A branch name may hold characters that end an attribute value; the
+	// prefix and dir come URL-escaped, and HTML needs & escaped on top.
+	prefix := escapePath(`/pages/a"b c<&$1/`)
+	dir := escapePath(`d'e/`)
+	got := string(rewriteRootURLs([]byte(`<a href="/x">x</a><img srcset="/y 1x">`), "text/html", prefix, dir))
+	want := `<base href="/pages/a%22b%20c%3C&amp;$1/d%27e/"><a href="/pages/a%22b%20c%3C&amp;$1/x">x</a><img srcset="/pages/a%22b%20c%3C&amp;$1/y 1x">`
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
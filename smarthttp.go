@@ -0,0 +1,148 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// gitProtocolPattern limits the Git-Protocol header to the key=value list
+// format git understands, e.g. "version=2".
+var gitProtocolPattern = regexp.MustCompile(`^[A-Za-z0-9=:._-]+$`)
+
+// cloneURLPath returns the path under which the repository is served over
+// the smart HTTP protocol, e.g. "/gitViewer.git".
+func (s *Server) cloneURLPath() string {
+	return s.cfg.BasePath + "/" + s.repoName + ".git"
+}
+
+// handleSmartHTTP implements the read-only side of Git's smart HTTP
+// protocol so the repository can be cloned and fetched from gitViewer.
+//
+// Only git-upload-pack is served. Pushes (git-receive-pack) and the dumb
+// HTTP protocol are refused.
+func (s *Server) handleSmartHTTP(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, s.cloneURLPath())
+	switch rest {
+	case "/info/refs":
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		switch service := r.URL.Query().Get("service"); service {
+		case "git-upload-pack":
+			s.serveInfoRefs(w, r)
+		case "git-receive-pack":
+			http.Error(w, "pushing to gitViewer is not supported", http.StatusForbidden)
+		default:
+			http.Error(w, "only the smart HTTP protocol is supported", http.StatusForbidden)
+		}
+	case "/git-upload-pack":
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.serveUploadPack(w, r)
+	case "/git-receive-pack":
+		http.Error(w, "pushing to gitViewer is not supported", http.StatusForbidden)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveInfoRefs advertises the repository's refs to a fetching client.
+func (s *Server) serveInfoRefs(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	version := gitProtocolEnv(r)
+	cmd := exec.CommandContext(ctx, "git", "upload-pack", "--stateless-rpc", "--advertise-refs", s.repoPath)
+	release, err := acquireGit(ctx, cmd.Args[1:])
+	if err != nil {
+		s.httpError(w, r, http.StatusServiceUnavailable, "Server busy", err)
+		return
+	}
+	defer release()
+
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+	setNoCache(w)
+
+	// Protocol v2 responses start directly with the capability advertisement.
+	if !strings.Contains(version, "version=2") {
+		_, _ = io.WriteString(w, pktLine("# service=git-upload-pack\n"))
+		_, _ = io.WriteString(w, "0000")
+	}
+
+	cmd.Env = append(os.Environ(), version)
+	cmd.Stdout = w
+	if err := cmd.Run(); err != nil {
+		slog.ErrorContext(ctx, "git upload-pack failed", "args", cmd.Args[1:], "err", err)
+	}
+}
+
+// serveUploadPack runs a stateless upload-pack negotiation for a client.
+func (s *Server) serveUploadPack(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if ct := r.Header.Get("Content-Type"); ct != "application/x-git-upload-pack-request" {
+		http.Error(w, "unexpected content type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body := io.Reader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, "invalid gzip request body", http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	cmd := exec.CommandContext(ctx, "git", "upload-pack", "--stateless-rpc", s.repoPath)
+	release, err := acquireGit(ctx, cmd.Args[1:])
+	if err != nil {
+		s.httpError(w, r, http.StatusServiceUnavailable, "Server busy", err)
+		return
+	}
+	defer release()
+
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+	setNoCache(w)
+
+	cmd.Env = append(os.Environ(), gitProtocolEnv(r))
+	cmd.Stdin = body
+	cmd.Stdout = w
+	if err := cmd.Run(); err != nil {
+		// Headers are already sent; all we can do is log.
+		slog.ErrorContext(ctx, "git upload-pack failed", "args", cmd.Args[1:], "err", err)
+	}
+}
+
+// gitProtocolEnv forwards a well-formed Git-Protocol request header to git
+// as GIT_PROTOCOL, which enables protocol v2 when the client asks for it.
+func gitProtocolEnv(r *http.Request) string {
+	proto := r.Header.Get("Git-Protocol")
+	if proto == "" || !gitProtocolPattern.MatchString(proto) {
+		return "GIT_PROTOCOL="
+	}
+	return "GIT_PROTOCOL=" + proto
+}
+
+// pktLine encodes s as a single Git pkt-line.
+func pktLine(s string) string {
+	return fmt.Sprintf("%04x%s", len(s)+4, s)
+}
+
+// setNoCache marks a response as not cacheable.
+func setNoCache(w http.ResponseWriter) {
+	w.Header().Set("Expires", "Fri, 01 Jan 1980 00:00:00 GMT")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Cache-Control", "no-cache, max-age=0, must-revalidate")
+}
@@ -83,8 +83,36 @@
     });
   }
 
+  /**
+   * Keep the two frames of the pages compare view scrolled together.
+   *
+   * The framed pages report their scroll position with postMessage (see
+   * pagesync.js); it is passed on to the other frame unless the
+   * `[data-role='sync-toggle']` checkbox is cleared.
+   */
+  function initPagesCompare() {
+    /** @type {HTMLIFrameElement[]} */
+    const frames = Array.from(
+      document.querySelectorAll("iframe[data-role='compare-frame']")
+    );
+    if (frames.length !== 2) return;
+
+    /** @type {HTMLInputElement|null} */
+    const toggle = document.querySelector("[data-role='sync-toggle']");
+
+    window.addEventListener("message", event => {
+      const data = event.data;
+      if (!data || data.type !== "gitviewer-sync") return;
+      const from = frames.findIndex(frame => frame.contentWindow === event.source);
+      if (from < 0 || (toggle && !toggle.checked)) return;
+      const other = frames[1 - from].contentWindow;
+      if (other) other.postMessage({ type: data.type, x: data.x, y: data.y }, "*");
+    });
+  }
+
   document.addEventListener("DOMContentLoaded", () => {
     initThemeToggle();
     initCollapsibles();
+    initPagesCompare();
   });
 })();
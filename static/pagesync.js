@@ -0,0 +1,45 @@
+/**
+ * Scroll synchronization for pages shown side by side on the gitViewer
+ * compare page.
+ *
+ * Added to pages requested with `?gitviewer-sync`. The frames cannot see
+ * each other, so each reports its scroll position to the compare page,
+ * which passes it on to the other frame.
+ *
+ * @file
+ */
+(() => {
+  "use strict";
+
+  const MESSAGE_TYPE = "gitviewer-sync";
+
+  if (window.parent === window) return;
+
+  /** @type {{x: number, y: number}|null} */
+  let applied = null;
+
+  window.addEventListener(
+    "scroll",
+    () => {
+      // Do not echo a position the other frame sent.
+      if (applied && applied.x === window.scrollX && applied.y === window.scrollY) {
+        applied = null;
+        return;
+      }
+      window.parent.postMessage(
+        { type: MESSAGE_TYPE, x: window.scrollX, y: window.scrollY },
+        "*"
+      );
+    },
+    { passive: true }
+  );
+
+  window.addEventListener("message", event => {
+    const data = event.data;
+    if (event.source !== window.parent || !data || data.type !== MESSAGE_TYPE) {
+      return;
+    }
+    applied = { x: data.x, y: data.y };
+    window.scrollTo(data.x, data.y);
+  });
+})();
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// selfSignedValidity is how long generated certificates are valid. Some
+// clients reject leaf certificates valid for more than 398 days.
+const selfSignedValidity = 397 * 24 * time.Hour
+
+// selfSignedRenewBefore is how long before expiry a generated certificate
+// is replaced on startup.
+const selfSignedRenewBefore = 30 * 24 * time.Hour
+
+// TLSConfig configures HTTPS. It is enabled as soon as a certificate or
+// self-signed host names are configured.
+type TLSConfig struct {
+	Cert         string
+	Key          string
+	SelfSigned   []string // host names and IPs to generate a certificate for
+	HTTPRedirect string   // plain HTTP address redirecting to HTTPS
+	HSTSMaxAge   int      // seconds; 0 disables Strict-Transport-Security
+}
+
+// enabled reports whether the server should serve HTTPS.
+func (t TLSConfig) enabled() bool {
+	return t.Cert != "" || t.Key != "" || len(t.SelfSigned) > 0
+}
+
+// certFiles returns the certificate and key paths, defaulting to the user
+// config directory for self-signed certificates.
+func (t TLSConfig) certFiles() (string, string, error) {
+	if t.Cert != "" || len(t.SelfSigned) == 0 {
+		return t.Cert, t.Key, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", "", fmt.Errorf("tls: no cert path configured: %w", err)
+	}
+	dir = filepath.Join(dir, "gitViewer")
+	return filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), nil
+}
+
+// loadTLS returns the server TLS configuration, generating a self-signed
+// certificate first if one is configured and missing or outdated.
+func loadTLS(t TLSConfig) (*tls.Config, error) {
+	certFile, keyFile, err := t.certFiles()
+	if err != nil {
+		return nil, err
+	}
+	if len(t.SelfSigned) > 0 {
+		if err := ensureSelfSigned(certFile, keyFile, t.SelfSigned); err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}, nil
+}
+
+// ensureSelfSigned writes a new self-signed certificate for hosts unless
+// certFile already holds one that covers all of them and is not about to
+// expire. Keeping the certificate stable lets clients trust it once.
+func ensureSelfSigned(certFile, keyFile string, hosts []string) error {
+	if ok, err := certCovers(certFile, keyFile, hosts); err != nil {
+		slog.Info("replacing certificate", "path", certFile, "reason", err)
+	} else if ok {
+		return nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"gitViewer"}, CommonName: hosts[0]},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		// A leaf: trusting it must not let its key, which sits on disk,
+		// sign certificates for other hosts.
+		IsCA: false,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.MkdirAll(filepath.Dir(f), 0o700); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		return err
+	}
+	slog.Info("generated self-signed certificate", "path", certFile, "hosts", hosts)
+	return nil
+}
+
+// certCovers reports whether the certificate in certFile is usable with
+// keyFile, valid for every host and not close to expiry. Missing files are
+// not an error.
+func certCovers(certFile, keyFile string, hosts []string) (bool, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	cert := pair.Leaf
+	if cert == nil {
+		if cert, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+			return false, err
+		}
+	}
+	if cert.IsCA || cert.KeyUsage&x509.KeyUsageCertSign != 0 {
+		return false, errors.New("certificate can sign other certificates")
+	}
+	if time.Until(cert.NotAfter) < selfSignedRenewBefore {
+		return false, errors.New("certificate is about to expire")
+	}
+	for _, h := range hosts {
+		if err := cert.VerifyHostname(h); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// hstsMiddleware tells browsers to only use HTTPS for the next maxAge
+// seconds.
+func hstsMiddleware(next http.Handler, maxAge int) http.Handler {
+	value := "max-age=" + strconv.Itoa(maxAge)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// redirectToHTTPS sends plain HTTP requests to the same host and path on
+// the HTTPS port.
+func redirectToHTTPS(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if host == "" {
+			http.Error(w, "missing Host header", http.StatusBadRequest)
+			return
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		} else if net.ParseIP(host) != nil && net.ParseIP(host).To4() == nil {
+			host = "[" + host + "]"
+		}
+		code := http.StatusPermanentRedirect // keeps the method and body
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			code = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), code)
+	})
+}
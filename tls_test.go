@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// loadLeaf parses the certificate that ensureSelfSigned wrote.
+func loadLeaf(t *testing.T, certFile, keyFile string) *x509.Certificate {
+	t.Helper()
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestEnsureSelfSignedLeaf(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	hosts := []string{"localhost", "git.example.test", "127.0.0.1"}
+	if err := ensureSelfSigned(certFile, keyFile, hosts); err != nil {
+		t.Fatal(err)
+	}
+	cert := loadLeaf(t, certFile, keyFile)
+
+	if cert.IsCA {
+		t.Error("certificate is a CA")
+	}
+	if cert.KeyUsage&x509.KeyUsageCertSign != 0 {
+		t.Error("certificate may sign certificates")
+	}
+	if cert.KeyUsage&x509.KeyUsageDigitalSignature == 0 {
+		t.Error("certificate lacks the digital signature key usage")
+	}
+	if len(cert.ExtKeyUsage) != 1 || cert.ExtKeyUsage[0] != x509.ExtKeyUsageServerAuth {
+		t.Errorf("ExtKeyUsage = %v, want server auth only", cert.ExtKeyUsage)
+	}
+	for _, h := range hosts {
+		if err := cert.VerifyHostname(h); err != nil {
+			t.Errorf("VerifyHostname(%q): %v", h, err)
+		}
+	}
+
+	// A browser that trusts the certificate accepts it for its hosts.
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	if _, err := cert.Verify(x509.VerifyOptions{DNSName: "git.example.test", Roots: roots}); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+
+	// It is kept while it still covers the hosts.
+	if err := ensureSelfSigned(certFile, keyFile, hosts[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if again := loadLeaf(t, certFile, keyFile); again.SerialNumber.Cmp(cert.SerialNumber) != 0 {
+		t.Error("certificate covering the hosts was replaced")
+	}
+}
+
+func TestEnsureSelfSignedReplacesCA(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	// A CA certificate as written by earlier versions.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ensureSelfSigned(certFile, keyFile, []string{"localhost"}); err != nil {
+		t.Fatal(err)
+	}
+	if cert := loadLeaf(t, certFile, keyFile); cert.IsCA {
+		t.Error("CA certificate was kept")
+	}
+}
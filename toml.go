@@ -0,0 +1,197 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/pelletier/go-toml/v2/unstable"
+)
+
+// The config file is TOML 1.0, parsed by github.com/pelletier/go-toml. The
+// decoder in config.go works on a tree of tomlTable and tomlValue instead
+// of Go structs so that it can report the line of every bad setting.
+
+// tomlValue is a parsed value together with the line it was defined on.
+type tomlValue struct {
+	line int
+	v    any // string, int64, bool, []tomlValue, tomlTable, []tomlTable, or float64 and time values
+}
+
+// tomlTable maps keys to values.
+type tomlTable map[string]tomlValue
+
+// keys returns the table's keys in the order they were defined.
+func (t tomlTable) keys() []string {
+	keys := make([]string, 0, len(t))
+	for k := range t {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		return cmp.Or(cmp.Compare(t[a].line, t[b].line), strings.Compare(a, b))
+	})
+	return keys
+}
+
+// tomlError is a syntax error at a specific line.
+type tomlError struct {
+	line int
+	msg  string
+}
+
+func (e *tomlError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.line, e.msg)
+}
+
+// parseTOML parses data into a table tree.
+func parseTOML(data string) (tomlTable, error) {
+	var doc map[string]any
+	if err := toml.Unmarshal([]byte(data), &doc); err != nil {
+		var derr *toml.DecodeError
+		if errors.As(err, &derr) {
+			line, _ := derr.Position()
+			return nil, &tomlError{line: line, msg: strings.TrimPrefix(derr.Error(), "toml: ")}
+		}
+		return nil, err
+	}
+	lines, err := tomlLines([]byte(data))
+	if err != nil {
+		return nil, err
+	}
+	return tomlTree(doc, "", lines, 1).(tomlTable), nil
+}
+
+// tomlTree converts a value decoded by go-toml, found at path, into the
+// tree the config decoder reads. Arrays whose elements are all tables,
+// whether [[headers]] or inline, become []tomlTable.
+func tomlTree(v any, path string, lines map[string]int, line int) any {
+	switch v := v.(type) {
+	case map[string]any:
+		t := make(tomlTable, len(v))
+		for k, child := range v {
+			p := tomlPath(path, k)
+			l := cmp.Or(lines[p], line)
+			t[k] = tomlValue{line: l, v: tomlTree(child, p, lines, l)}
+		}
+		return t
+	case []any:
+		tables := make([]tomlTable, 0, len(v))
+		values := make([]tomlValue, 0, len(v))
+		for i, elem := range v {
+			p := tomlPath(path, strconv.Itoa(i))
+			l := cmp.Or(lines[p], line)
+			converted := tomlTree(elem, p, lines, l)
+			if t, ok := converted.(tomlTable); ok {
+				tables = append(tables, t)
+			}
+			values = append(values, tomlValue{line: l, v: converted})
+		}
+		if len(v) > 0 && len(tables) == len(v) {
+			return tables
+		}
+		return values
+	}
+	return v
+}
+
+// tomlPath appends key to a path of keys and array indexes.
+func tomlPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "\x00" + key
+}
+
+// tomlLines returns the line on which each key, table and array element
+// of data is first defined, by path as built with tomlPath.
+func tomlLines(data []byte) (map[string]int, error) {
+	lines := make(map[string]int)
+	var p unstable.Parser
+	p.Reset(data)
+	lineOf := func(n *unstable.Node) int { return p.Shape(n.Raw).Start.Line }
+	define := func(path string, line int) {
+		if _, ok := lines[path]; !ok {
+			lines[path] = line
+		}
+	}
+
+	// walkValue records the lines of the elements and keys inside a value.
+	var walkValue func(path string, n *unstable.Node, line int)
+	walkKeyValue := func(prefix string, kv *unstable.Node) {
+		path := prefix
+		for it := kv.Key(); it.Next(); {
+			key := it.Node()
+			path = tomlPath(path, string(key.Data))
+			define(path, lineOf(key))
+		}
+		walkValue(path, kv.Value(), lines[path])
+	}
+	walkValue = func(path string, n *unstable.Node, line int) {
+		switch n.Kind {
+		case unstable.Array:
+			i := 0
+			for it := n.Children(); it.Next(); {
+				elem := it.Node()
+				if elem.Kind == unstable.Comment {
+					continue
+				}
+				p := tomlPath(path, strconv.Itoa(i))
+				l := line
+				if elem.Raw.Length > 0 {
+					l = lineOf(elem)
+				}
+				define(p, l)
+				walkValue(p, elem, l)
+				i++
+			}
+		case unstable.InlineTable:
+			for it := n.Children(); it.Next(); {
+				if kv := it.Node(); kv.Kind == unstable.KeyValue {
+					walkKeyValue(path, kv)
+				}
+			}
+		}
+	}
+
+	// Array tables are numbered per parent element, so [[a.b]] under the
+	// second [[a]] is a\x001\x00b.
+	arrays := make(map[string]int) // path of an array table -> index of its last element
+	resolve := func(header *unstable.Node, array bool) string {
+		path := ""
+		for it := header.Key(); it.Next(); {
+			key := it.Node()
+			path = tomlPath(path, string(key.Data))
+			define(path, lineOf(key))
+			if it.IsLast() && array {
+				i, ok := arrays[path]
+				if ok {
+					i++
+				}
+				arrays[path] = i
+				path = tomlPath(path, strconv.Itoa(i))
+				define(path, lineOf(key))
+			} else if i, ok := arrays[path]; ok {
+				path = tomlPath(path, strconv.Itoa(i))
+			}
+		}
+		return path
+	}
+
+	table := ""
+	for p.NextExpression() {
+		e := p.Expression()
+		switch e.Kind {
+		case unstable.Table:
+			table = resolve(e, false)
+		case unstable.ArrayTable:
+			table = resolve(e, true)
+		case unstable.KeyValue:
+			walkKeyValue(table, e)
+		}
+	}
+	return lines, p.Error()
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// plainTOML turns parsed values into plain Go values, without line
+// numbers, for comparison.
+func plainTOML(v any) any {
+	switch v := v.(type) {
+	case tomlTable:
+		m := map[string]any{}
+		for k, tv := range v {
+			m[k] = plainTOML(tv.v)
+		}
+		return m
+	case []tomlTable:
+		out := []any{}
+		for _, t := range v {
+			out = append(out, plainTOML(t))
+		}
+		return out
+	case []tomlValue:
+		out := []any{}
+		for _, tv := range v {
+			out = append(out, plainTOML(tv.v))
+		}
+		return out
+	}
+	return v
+}
+
+func TestParseTOML(t *testing.T) {
+	tests := []struct {
+		name, src string
+		want      map[string]any
+	}{
+		{"empty", "", map[string]any{}},
+		{"comments and blank lines", "# a comment\n\n  # another\r\n", map[string]any{}},
+		{"scalars", "s = \"x\" # trailing\nn = -1_000\np = +7\nt = true\nf = false\n",
+			map[string]any{"s": "x", "n": int64(-1000), "p": int64(7), "t": true, "f": false}},
+		{"keys", "bare-key_1 = 1\n\"quoted key\" = 2\n'literal key' = 3\n",
+			map[string]any{"bare-key_1": int64(1), "quoted key": int64(2), "literal key": int64(3)}},
+		{"escapes", `s = "a\"b\\c\nd\te\rf\u00e9\U0001F600"`,
+			map[string]any{"s": "a\"b\\c\nd\te\rf\u00e9\U0001F600"}},
+		{"literal string", `s = 'C:\path\n "quoted"'`,
+			map[string]any{"s": `C:\path\n "quoted"`}},
+		{"unicode text", `s = "grüße # not a comment"`,
+			map[string]any{"s": "grüße # not a comment"}},
+		{"arrays", "a = []\nb = [1, 2,]\nc = [\n  \"x\", # first\n  'y',\n\n]\nd = [[1], [true, \"z\"]]\n",
+			map[string]any{
+				"a": []any{},
+				"b": []any{int64(1), int64(2)},
+				"c": []any{"x", "y"},
+				"d": []any{[]any{int64(1)}, []any{true, "z"}},
+			}},
+		{"tables", "top = 1\n[limits]\nmax = 2\n[ \"quoted\" ]\nk = 'v'\n",
+			map[string]any{
+				"top":    int64(1),
+				"limits": map[string]any{"max": int64(2)},
+				"quoted": map[string]any{"k": "v"},
+			}},
+		{"arrays of tables", "[[acl]]\naccess = \"deny\"\n[[acl]]\n[[ acl ]]\nrepos = [\"a\"]\n",
+			map[string]any{"acl": []any{
+				map[string]any{"access": "deny"},
+				map[string]any{},
+				map[string]any{"repos": []any{"a"}},
+			}}},
+		{"crlf line endings", "a = 1\r\n[t]\r\nb = 'x'\r\n",
+			map[string]any{"a": int64(1), "t": map[string]any{"b": "x"}}},
+		{"dotted keys", "a.b = 1\n[t.u]\nv.w = 'x'\n",
+			map[string]any{
+				"a": map[string]any{"b": int64(1)},
+				"t": map[string]any{"u": map[string]any{"v": map[string]any{"w": "x"}}},
+			}},
+		{"inline tables", "limits = { max_preview = 1, git_slots = 2 }\n",
+			map[string]any{"limits": map[string]any{"max_preview": int64(1), "git_slots": int64(2)}}},
+		{"inline array of tables", "repo = [{ path = '/a' }, { path = '/b' }]\n",
+			map[string]any{"repo": []any{map[string]any{"path": "/a"}, map[string]any{"path": "/b"}}}},
+		{"multi-line strings", "s = \"\"\"\nline 1\nline 2\"\"\"\nl = '''\nC:\\x'''\n",
+			map[string]any{"s": "line 1\nline 2", "l": `C:\x`}},
+		{"other integer forms", "h = 0xff\no = 0o17\nb = 0b101\n",
+			map[string]any{"h": int64(255), "o": int64(15), "b": int64(5)}},
+		{"floats", "f = 1.5\n", map[string]any{"f": 1.5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := parseTOML(tt.src)
+			if err != nil {
+				t.Fatalf("parseTOML(%q): %v", tt.src, err)
+			}
+			if got := plainTOML(doc); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseTOML(%q) = %#v, want %#v", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTOMLLines(t *testing.T) {
+	doc, err := parseTOML("# header\n\nb = 1\na = [\n  'x',\n  'y',\n]\n\n[[t]]\nc = 2\n[[t]]\nd = 3\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := doc.keys(), []string{"b", "a", "t"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("keys() = %q, want %q", got, want)
+	}
+	lines := map[string]int{"b": doc["b"].line, "a": doc["a"].line, "t": doc["t"].line}
+	if want := map[string]int{"b": 3, "a": 4, "t": 9}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("lines = %v, want %v", lines, want)
+	}
+	if items := doc["a"].v.([]tomlValue); items[1].line != 6 {
+		t.Errorf("second array item on line %d, want 6", items[1].line)
+	}
+	tables := doc["t"].v.([]tomlTable)
+	if tables[0]["c"].line != 10 || tables[1]["d"].line != 12 {
+		t.Errorf("table keys on lines %d and %d, want 10 and 12", tables[0]["c"].line, tables[1]["d"].line)
+	}
+}
+
+func TestParseTOMLLinesNested(t *testing.T) {
+	doc, err := parseTOML(`[[a]]
+x = 1
+[[a.b]]
+y = 2
+[[a]]
+[[a.b]]
+y = 3
+[[a.b]]
+y = 4
+[t]
+u.v = 5
+inline = { w = 6,
+  z = [{ k = 7 }] }
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := doc["a"].v.([]tomlTable)
+	b0, b1 := a[0]["b"].v.([]tomlTable), a[1]["b"].v.([]tomlTable)
+	tbl := doc["t"].v.(tomlTable)
+	inline := tbl["inline"].v.(tomlTable)
+	lines := map[string]int{
+		"a[0].x":          a[0]["x"].line,
+		"a[0].b[0].y":     b0[0]["y"].line,
+		"a[1].b[0].y":     b1[0]["y"].line,
+		"a[1].b[1].y":     b1[1]["y"].line,
+		"t":               doc["t"].line,
+		"t.u.v":           tbl["u"].v.(tomlTable)["v"].line,
+		"t.inline.w":      inline["w"].line,
+		"t.inline.z[0].k": inline["z"].v.([]tomlTable)[0]["k"].line,
+	}
+	want := map[string]int{
+		"a[0].x":          2,
+		"a[0].b[0].y":     4,
+		"a[1].b[0].y":     7,
+		"a[1].b[1].y":     9,
+		"t":               10,
+		"t.u.v":           11,
+		"t.inline.w":      12,
+		"t.inline.z[0].k": 13,
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("lines = %v, want %v", lines, want)
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	tests := []struct {
+		name, src, want string
+	}{
+		{"missing value", "a =\n", "line 1: unexpected character U+000A at start of value"},
+		{"missing equals", "\n\na 1\n", "line 3: expected '=' after key"},
+		{"no key", "= 1\n", "line 1: invalid character at start of key: U+003D '='"},
+		{"bare string", "a = main\n", "line 1: unexpected character U+006D 'm' at start of value"},
+		{"integer overflow", "a = 99999999999999999999\n", "line 1: decimal number is too large to fit in a 64-bit signed integer"},
+		{"junk after value", "a = 1 2\n", "line 1: expected newline but got U+0032 '2'"},
+		{"duplicate key", "a = 1\n\na = 2\n", "line 3: key a is already defined"},
+		{"duplicate table", "[t]\n[u]\n[t]\n", "line 3: table t already exists"},
+		{"table then array of tables", "[t]\n[[t]]\n", "line 2: key t already exists as a table, but should be an array table"},
+		{"unclosed table header", "[t\n", "line 1: expected ']' to close table name"},
+		{"unclosed array of tables", "[[t]\n", "line 1: expected ']]' to close array table name"},
+		{"unterminated string", "a = \"x\nb = 1\n", "line 1: basic strings cannot have new lines"},
+		{"unterminated literal string", "\na = 'x\n", "line 2: literal strings cannot have new lines"},
+		{"invalid escape", `a = "\q"`, "line 1: invalid escape character U+0071 'q'"},
+		{"short unicode escape", `a = "\u12"`, "line 1: unicode escape sequence is too short"},
+		{"surrogate escape", `a = "\uD800"`, "line 1: escape sequence is not a valid unicode code point"},
+		{"unterminated array", "a = [1,\n2,\n", "line 2: array is incomplete"},
+		{"missing comma", "a = [\n1\n2]\n", "line 3: expected ',' or ']' after array value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseTOML(tt.src)
+			if err == nil {
+				t.Fatalf("parseTOML(%q) succeeded, want %q", tt.src, tt.want)
+			}
+			if err.Error() != tt.want {
+				t.Errorf("parseTOML(%q) = %q, want %q", tt.src, err, tt.want)
+			}
+		})
+	}
+}